@@ -2,23 +2,60 @@ package api
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
-	"os"
 	"time"
 	"voting-blockchain/pkg/block"
 	"voting-blockchain/pkg/consensus"
+	"voting-blockchain/pkg/cryptography"
+	"voting-blockchain/pkg/ledger"
 	"voting-blockchain/pkg/network"
+	"voting-blockchain/pkg/smartcontract"
 	"voting-blockchain/pkg/storage"
 )
 
 var (
-	roomStore   = storage.NewRoomStore()
-	ballotStore = storage.NewBallotStore()
-	nodeAddress = "http://localhost:8080" // Define the current node's address
+	// The node whose rooms the API serves
+	node *network.Node
+
+	roomStore   storage.RoomStore   = storage.NewMemoryRoomStore()
+	ballotStore storage.BallotStore = storage.NewMemoryBallotStore()
+
+	// Signs ballot outcomes and the ledger bundles exported over the API
+	identity *cryptography.Identity
+
+	// Nodes whose ledger bundles may be imported over the API
+	bundleSigners map[string]bool
 )
 
+// UseNode sets the node whose rooms the API serves. It must be called
+// before Main.
+func UseNode(n *network.Node) {
+	node = n
+}
+
+// UseStores sets where room and ballot metadata is kept. Metadata is kept in
+// memory unless this is called before Main.
+func UseStores(rooms storage.RoomStore, ballots storage.BallotStore) {
+	roomStore, ballotStore = rooms, ballots
+}
+
+// UseIdentity sets the node key that ballot outcomes and the ledger bundles
+// exported over the API are signed with. Ballots cannot be tallied, and
+// bundles are exported unsigned, unless this is called.
+func UseIdentity(id *cryptography.Identity) {
+	identity = id
+}
+
+// TrustBundleSigners sets the nodes whose signed ledger bundles may be
+// imported over the API, normally the peer allowlist. Bundles signed with
+// the node's own identity are accepted too; unsigned bundles never are.
+func TrustBundleSigners(ids map[string]bool) {
+	bundleSigners = ids
+}
+
 // --- CORS middleware ---
 func withCORS(handler http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -33,63 +70,85 @@ func withCORS(handler http.HandlerFunc) http.HandlerFunc {
 	}
 }
 
-// Validate a specific ledger
-func validateLedger(filename string) error {
-	blockchain, err := block.LoadBlockchain(filename)
-	if err != nil {
-		return fmt.Errorf("failed to load blockchain from %s: %v", filename, err)
-	}
-
-	if !block.ValidateBlockchain(blockchain) {
-		return fmt.Errorf("blockchain in %s is invalid or tampered with", filename)
-	}
-
-	return nil
-}
-
 // Create a new room
 func createRoomHandler(w http.ResponseWriter, r *http.Request) {
 	var req struct {
-		RoomID      string `json:"roomId"`
+		RoomID      string `json:"roomId"` // optional, generated if empty
 		Name        string `json:"name"`
 		Description string `json:"description"`
-		Type        string `json:"type"` // "public" or "private"
+		Type        string `json:"type"`      // "public" or "private"
+		CreatorID   string `json:"creatorId"` // optional, becomes the room's first admin
+		// The creator's join, signed as for /api/rooms/join
+		CreatorKey       string `json:"creatorKey"`
+		CreatorSignature string `json:"creatorSignature"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, "Invalid request body", http.StatusBadRequest)
 		return
 	}
-
-	// Create a new room
-	room, err := roomStore.CreateRoom(req.Name, req.Description, req.Type)
-	if err != nil {
-		http.Error(w, "Failed to create room", http.StatusInternalServerError)
-		return
+	if req.RoomID != "" {
+		if err := ledger.ValidRoomID(req.RoomID); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
 	}
 
-	// Ensure the ledgers directory exists
-	if _, err := os.Stat("ledgers"); os.IsNotExist(err) {
-		err := os.Mkdir("ledgers", 0755)
+	// The first member to join a room becomes its admin. The join is signed
+	// for the room's ID, so the ID cannot be left to be generated, and is
+	// checked before anything is created.
+	var join block.VoteData
+	if req.CreatorID != "" {
+		if req.RoomID == "" {
+			http.Error(w, "roomId is required to sign the creator's join", http.StatusBadRequest)
+			return
+		}
+		change := smartcontract.MembershipChange{Action: smartcontract.ActionJoin, Key: req.CreatorKey, Signature: req.CreatorSignature}
+		var err error
+		join, err = smartcontract.MembershipRecord(req.CreatorID, change)
+		if err == nil {
+			state := smartcontract.NewState()
+			state.Apply(*block.CreateRoomGenesisBlock(req.RoomID))
+			err = state.Validate(join, time.Now().Unix())
+		}
 		if err != nil {
-			http.Error(w, "Failed to create ledgers directory", http.StatusInternalServerError)
+			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
 	}
 
-	// Initialize a new blockchain for the room using the provided roomId
-	filename := fmt.Sprintf("./ledgers/blockchain-%s.json", req.RoomID)
-	genesisBlock := block.CreateGenesisBlock()
+	// Create a new room
+	room, err := roomStore.CreateRoom(req.RoomID, req.Name, req.Description, req.Type)
+	if errors.Is(err, storage.ErrExists) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to create room", http.StatusInternalServerError)
+		return
+	}
+
+	// Initialize a new blockchain for the room under the id it was created with
+	genesisBlock := block.CreateRoomGenesisBlock(room.ID)
 	genesisBlock.Hash = consensus.ProofOfWork(genesisBlock)
 	blockchain := []block.Block{*genesisBlock}
-	if err := block.SaveBlockchain(filename, blockchain); err != nil {
+	if err := node.Ledgers.Create(room.ID, *genesisBlock); err != nil {
+		roomStore.DeleteRoom(room.ID)
 		http.Error(w, "Failed to initialize blockchain", http.StatusInternalServerError)
 		return
 	}
 
-	// Broadcast the room creation to all known nodes
-	for _, peer := range network.KnownNodes {
-		if peer != nodeAddress {
-			network.SendRoom(peer, req.RoomID, blockchain)
+	// Offer the new room to all known nodes
+	node.AnnounceRoom(room.ID, blockchain)
+
+	if req.CreatorID != "" {
+		if _, err := addRecord(room.ID, join); err != nil {
+			writeRecordError(w, err)
+			return
+		}
+		syncRoomMembers(room.ID)
+		if room, err = roomStore.GetRoom(room.ID); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
 		}
 	}
 
@@ -101,9 +160,17 @@ func createRoomHandler(w http.ResponseWriter, r *http.Request) {
 func createBallotHandler(w http.ResponseWriter, r *http.Request) {
 	var req struct {
 		RoomID      string   `json:"roomId"`
+		BallotID    string   `json:"ballotId"` // optional, generated if empty
 		Title       string   `json:"title"`
 		Description string   `json:"description"`
 		Options     []string `json:"options"`
+		Draft       bool     `json:"draft"`
+		StartTime   int64    `json:"startTime"` // unix seconds
+		EndTime     int64    `json:"endTime"`   // unix seconds
+		// The admin signing the ballot's initial state record
+		By        string `json:"by"`
+		Nonce     int64  `json:"nonce"`
+		Signature string `json:"signature"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, "Invalid request body", http.StatusBadRequest)
@@ -111,101 +178,385 @@ func createBallotHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Create a new ballot
-	ballot, err := ballotStore.CreateBallot(req.RoomID, req.Title, req.Description, req.Options)
+	ballot, err := ballotStore.CreateBallot(req.BallotID, req.RoomID, req.Title, req.Description, req.Options)
+	if errors.Is(err, storage.ErrExists) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
 	if err != nil {
 		http.Error(w, "Failed to create ballot", http.StatusInternalServerError)
 		return
 	}
 
+	// Record the ballot's initial lifecycle state on the room's ledger. A
+	// ballot with a start time is scheduled, and opens once it has passed.
+	initial := smartcontract.Transition{State: smartcontract.StateOpen, StartTime: req.StartTime, EndTime: req.EndTime}
+	switch {
+	case req.Draft:
+		initial.State = smartcontract.StateDraft
+	case req.StartTime != 0:
+		initial.State = smartcontract.StateScheduled
+	}
+	record, err := smartcontract.TransitionRecord(ballot.ID, initial)
+	if err != nil {
+		ballotStore.DeleteBallot(ballot.RoomID, ballot.ID)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if _, err := addRecord(req.RoomID, signed(record, req.By, req.Nonce, req.Signature)); err != nil {
+		ballotStore.DeleteBallot(ballot.RoomID, ballot.ID)
+		writeRecordError(w, err)
+		return
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(ballot)
 }
 
+// Load a room's ledger. Blocks are verified when the ledger is opened and
+// as they are appended, so the chain is not revalidated here.
+func loadLedger(roomID string) (block.Blockchain, error) {
+	if err := ledger.ValidRoomID(roomID); err != nil {
+		return nil, err
+	}
+	blockchain, err := node.Ledgers.Chain(roomID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load blockchain: %v", err)
+	}
+	return blockchain, nil
+}
+
+// Load a room's current state, kept up to date by the ledger
+func loadState(roomID string) (*smartcontract.State, error) {
+	if err := ledger.ValidRoomID(roomID); err != nil {
+		return nil, err
+	}
+	return node.Ledgers.State(roomID)
+}
+
+// Build a record from the room's latest state and append it to the room's
+// ledger through the node, which mines it and announces it to peers
+func appendRecord(roomID string, build func(*smartcontract.State) (block.VoteData, error)) (block.Block, error) {
+	if err := ledger.ValidRoomID(roomID); err != nil {
+		return block.Block{}, err
+	}
+	return node.AppendRecord(roomID, build)
+}
+
+// Attach a member's signature to a record; unsigned requests leave it unsigned
+func signed(record block.VoteData, signer string, nonce int64, signature string) block.VoteData {
+	if signature != "" {
+		record.Signer, record.Nonce, record.Signature = signer, nonce, signature
+	}
+	return record
+}
+
 // Cast a vote in a ballot
 func castVoteHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		RoomID    string `json:"roomId"`
+		BallotID  string `json:"ballotId"`
+		UserID    string `json:"userId"`
+		ChoiceID  string `json:"choiceId"`
+		Nonce     int64  `json:"nonce"`
+		Signature string `json:"signature"` // by the voter, required in rooms with members
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	// Voters who already voted recast their vote as a revision, signed
+	// the same way as the vote
+	newBlock, err := appendRecord(req.RoomID, func(state *smartcontract.State) (block.VoteData, error) {
+		record, err := state.VoteRecord(req.BallotID, req.UserID, req.ChoiceID)
+		if err != nil {
+			return record, err
+		}
+		return signed(record, req.UserID, req.Nonce, req.Signature), nil
+	})
+	if _, ok := err.(network.RejectedError); ok {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if errors.Is(err, ledger.ErrBusy) {
+		writeBusy(w, err)
+		return
+	}
+	if err != nil {
+		log.Println(err) // Log the error for debugging
+		http.Error(w, err.Error()+". Vote not casted.", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(newBlock)
+}
+
+// Commit the voter weight table of a ballot to the room's ledger
+func setWeightsHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		RoomID    string                    `json:"roomId"`
+		BallotID  string                    `json:"ballotId"`
+		Weights   smartcontract.WeightTable `json:"weights"`
+		By        string                    `json:"by"` // Admin committing the table
+		Nonce     int64                     `json:"nonce"`
+		Signature string                    `json:"signature"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	record, err := req.Weights.Record(req.BallotID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	commitRecord(w, req.RoomID, signed(record, req.By, req.Nonce, req.Signature))
+}
+
+// Delegate a voter's vote to another voter, for one ballot or the whole room
+func delegateHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		RoomID    string `json:"roomId"`
+		BallotID  string `json:"ballotId"` // empty for a room-wide delegation
+		UserID    string `json:"userId"`
+		Delegate  string `json:"delegate"`
+		Nonce     int64  `json:"nonce"`
+		Signature string `json:"signature"` // by the delegator
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	record, err := smartcontract.DelegationRecord(req.UserID, req.BallotID, req.Delegate)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	commitRecord(w, req.RoomID, signed(record, req.UserID, req.Nonce, req.Signature))
+}
+
+// Revoke a voter's delegation in the given scope
+func revokeDelegationHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		RoomID    string `json:"roomId"`
+		BallotID  string `json:"ballotId"`
+		UserID    string `json:"userId"`
+		Nonce     int64  `json:"nonce"`
+		Signature string `json:"signature"` // by the delegator
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	record := smartcontract.RevocationRecord(req.UserID, req.BallotID)
+	commitRecord(w, req.RoomID, signed(record, req.UserID, req.Nonce, req.Signature))
+}
+
+// Commit the outcome rules of a ballot to the room's ledger
+func setPolicyHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		RoomID    string               `json:"roomId"`
+		BallotID  string               `json:"ballotId"`
+		Policy    smartcontract.Policy `json:"policy"`
+		By        string               `json:"by"` // Admin committing the policy
+		Nonce     int64                `json:"nonce"`
+		Signature string               `json:"signature"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	record, err := req.Policy.Record(req.BallotID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	commitRecord(w, req.RoomID, signed(record, req.By, req.Nonce, req.Signature))
+}
+
+// Move a ballot to a new lifecycle state, as signed by an admin of the room
+func transitionBallotHandler(w http.ResponseWriter, r *http.Request) {
 	var req struct {
 		RoomID   string `json:"roomId"`
 		BallotID string `json:"ballotId"`
-		UserID   string `json:"userId"`
-		ChoiceID string `json:"choiceId"`
+		smartcontract.Transition
+		By        string `json:"by"`
+		Nonce     int64  `json:"nonce"`
+		Signature string `json:"signature"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, "Invalid request body", http.StatusBadRequest)
 		return
 	}
 
-	// Load the blockchain for the room
-	filename := fmt.Sprintf("./ledgers/blockchain-%s.json", req.RoomID)
-	blockchain, err := block.LoadBlockchain(filename)
+	record, err := smartcontract.TransitionRecord(req.BallotID, req.Transition)
 	if err != nil {
-		http.Error(w, "Failed to load blockchain", http.StatusInternalServerError)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	record = signed(record, req.By, req.Nonce, req.Signature)
 
-	// Validate the ledger before adding a new block
-	if err := validateLedger(filename); err != nil {
-		log.Println(err) // Log the error for debugging
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	// Closing also tallies the ballot
+	if req.State == smartcontract.StateClosed {
+		closeBallot(w, req.RoomID, req.BallotID, record)
 		return
 	}
+	commitRecord(w, req.RoomID, record)
+}
 
-	// Create a new block for the vote 
-	lastBlock := blockchain[len(blockchain)-1]
-	newBlock := block.Block{
-		Index:     lastBlock.Index + 1,
-		Timestamp: time.Now().Unix(),
-		Data: block.VoteData{
-			BallotID: req.BallotID,
-			ChoiceID: req.ChoiceID,
-		},
-		PrevHash: lastBlock.Hash,
+// Close a ballot, as signed by an admin of the room, and append its
+// evaluated, signed outcome to the ledger
+func closeBallotHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		RoomID    string `json:"roomId"`
+		BallotID  string `json:"ballotId"`
+		By        string `json:"by"`
+		Nonce     int64  `json:"nonce"`
+		Signature string `json:"signature"` // of the closing state record
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
 	}
-	newBlock.Hash = consensus.ProofOfWork(&newBlock)
 
-	// Validate the new block before appending
-	if !block.ValidateBlock(&newBlock) {
-		http.Error(w, "New block is invalid. Vote not casted.", http.StatusBadRequest)
+	closing, err := smartcontract.TransitionRecord(req.BallotID, smartcontract.Transition{State: smartcontract.StateClosed})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	closeBallot(w, req.RoomID, req.BallotID, signed(closing, req.By, req.Nonce, req.Signature))
+}
 
-	// Append the new block to the blockchain
-	blockchain = append(blockchain, newBlock)
-	if err := block.SaveBlockchain(filename, blockchain); err != nil {
-		http.Error(w, "Failed to save blockchain", http.StatusInternalServerError)
+func closeBallot(w http.ResponseWriter, roomID, ballotID string, closing block.VoteData) {
+	outcomeBlock, err := tallyBallot(roomID, ballotID, closing)
+	if err != nil {
+		writeRecordError(w, err)
 		return
 	}
 
-	// Broadcast the entire blockchain to peers
-	for _, peer := range network.KnownNodes {
-		if peer != nodeAddress {
-			// Send the full blockchain for this room to the peer
-			network.SendRoom(peer, req.RoomID, blockchain)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(outcomeBlock)
+}
+
+// Append the closing state record, unless the ballot is already closed,
+// followed by the ballot's outcome record
+func tallyBallot(roomID, ballotID string, closing block.VoteData) (block.Block, error) {
+	state, err := loadState(roomID)
+	if err != nil {
+		return block.Block{}, err
+	}
+	if lc := state.LifecycleAt(ballotID, time.Now().Unix()); lc.State != smartcontract.StateClosed {
+		if _, err := addRecord(roomID, closing); err != nil {
+			return block.Block{}, err
 		}
 	}
+	return appendOutcome(roomID, ballotID)
+}
+
+// Append the outcome record of a closed ballot, evaluated against the chain
+// it is appended to and signed by this node
+func appendOutcome(roomID, ballotID string) (block.Block, error) {
+	return appendRecord(roomID, func(state *smartcontract.State) (block.VoteData, error) {
+		return state.OutcomeRecord(ballotID, identity)
+	})
+}
+
+// Get the lifecycle state of a ballot
+func getBallotStateHandler(w http.ResponseWriter, r *http.Request) {
+	roomID := r.URL.Query().Get("roomId")
+	ballotID := r.URL.Query().Get("ballotId")
+
+	state, err := loadState(roomID)
+	if err != nil {
+		writeQueryError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(state.LifecycleAt(ballotID, time.Now().Unix()))
+}
+
+// Get the recorded outcome of a closed ballot
+func getOutcomeHandler(w http.ResponseWriter, r *http.Request) {
+	roomID := r.URL.Query().Get("roomId")
+	ballotID := r.URL.Query().Get("ballotId")
+
+	state, err := loadState(roomID)
+	if err != nil {
+		writeQueryError(w, err)
+		return
+	}
+	outcome := state.Outcome(ballotID)
+	if outcome == nil {
+		http.Error(w, "Ballot has not been closed", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(outcome)
+}
+
+// Validate a record against the room's ledger, append it and write the new block
+func commitRecord(w http.ResponseWriter, roomID string, record block.VoteData) {
+	newBlock, err := addRecord(roomID, record)
+	if err != nil {
+		writeRecordError(w, err)
+		return
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(newBlock)
 }
 
+// Validate a record against the room's ledger and append it
+func addRecord(roomID string, record block.VoteData) (block.Block, error) {
+	return appendRecord(roomID, func(*smartcontract.State) (block.VoteData, error) {
+		return record, nil
+	})
+}
+
+// Report an addRecord failure with the matching status code
+func writeRecordError(w http.ResponseWriter, err error) {
+	if _, ok := err.(network.RejectedError); ok {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if errors.Is(err, ledger.ErrBusy) {
+		writeBusy(w, err)
+		return
+	}
+	log.Println(err)
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+}
+
+// Ask the client to retry a record the room was too busy to take
+func writeBusy(w http.ResponseWriter, err error) {
+	w.Header().Set("Retry-After", "1")
+	http.Error(w, err.Error(), http.StatusServiceUnavailable)
+}
+
 // Get ballot results
 func getResultsHandler(w http.ResponseWriter, r *http.Request) {
 	roomID := r.URL.Query().Get("roomId")
 	ballotID := r.URL.Query().Get("ballotId")
 
-	// Load the blockchain for the room
-	filename := fmt.Sprintf("./ledgers/blockchain-%s.json", roomID)
-	blockchain, err := block.LoadBlockchain(filename)
-	if err != nil {
-		http.Error(w, "Failed to load blockchain", http.StatusInternalServerError)
+	if err := ledger.ValidRoomID(roomID); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	// Calculate vote counts
-	results := make(map[string]int)
-	for _, block := range blockchain {
-		if block.Data.BallotID == ballotID {
-			results[block.Data.ChoiceID]++
-		}
+	// Calculate vote counts, weighted if the ballot has a weight table
+	results, err := ballotResults(roomID, ballotID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -222,8 +573,11 @@ func getLedgerHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	roomID := r.URL.Query().Get("roomId")
-	filename := fmt.Sprintf("./ledgers/blockchain-%s.json", roomID)
-	blockchain, err := block.LoadBlockchain(filename)
+	if err := ledger.ValidRoomID(roomID); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	blockchain, err := node.Ledgers.Chain(roomID)
 	if err != nil {
 		http.Error(w, "Failed to load blockchain", http.StatusInternalServerError)
 		return
@@ -232,14 +586,108 @@ func getLedgerHandler(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(blockchain)
 }
 
+// List the peers known to this node with their health and scores
+func getPeersHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(node.Peers.Records())
+}
+
+// Create rooms on POST and look them up on GET
+func roomsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		getRoomsHandler(w, r)
+		return
+	}
+	createRoomHandler(w, r)
+}
+
+// Create ballots on POST and look them up on GET
+func ballotsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		getBallotsHandler(w, r)
+		return
+	}
+	createBallotHandler(w, r)
+}
+
+// Get one room by roomId, or list every room
+func getRoomsHandler(w http.ResponseWriter, r *http.Request) {
+	var result interface{}
+	var err error
+	if roomID := r.URL.Query().Get("roomId"); roomID != "" {
+		result, err = roomStore.GetRoom(roomID)
+	} else {
+		result, err = roomStore.ListRooms()
+	}
+	writeStoreResult(w, result, err)
+}
+
+// Get one ballot by roomId and ballotId, or list the ballots of a room or of
+// every room
+func getBallotsHandler(w http.ResponseWriter, r *http.Request) {
+	roomID := r.URL.Query().Get("roomId")
+	ballotID := r.URL.Query().Get("ballotId")
+
+	var result interface{}
+	var err error
+	if ballotID != "" {
+		result, err = ballotStore.GetBallot(roomID, ballotID)
+	} else {
+		result, err = ballotStore.ListBallots(roomID)
+	}
+	writeStoreResult(w, result, err)
+}
+
+// Write a store lookup result, or its error with the matching status code
+func writeStoreResult(w http.ResponseWriter, result interface{}, err error) {
+	if errors.Is(err, storage.ErrNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
 // Main starts the API server
 func Main() {
 	// Define API routes with CORS
-	http.HandleFunc("/api/rooms", withCORS(createRoomHandler))
-	http.HandleFunc("/api/ballots", withCORS(createBallotHandler))
+	http.HandleFunc("/api/rooms", withCORS(roomsHandler))
+	http.HandleFunc("/api/rooms/members", withCORS(getMembersHandler))
+	http.HandleFunc("/api/rooms/members/nonce", withCORS(getMemberNonceHandler))
+	http.HandleFunc("/api/rooms/join", withCORS(membershipHandler(smartcontract.ActionJoin)))
+	http.HandleFunc("/api/rooms/leave", withCORS(membershipHandler(smartcontract.ActionLeave)))
+	http.HandleFunc("/api/rooms/approve", withCORS(membershipHandler(smartcontract.ActionApprove)))
+	http.HandleFunc("/api/rooms/reject", withCORS(membershipHandler(smartcontract.ActionReject)))
+	http.HandleFunc("/api/rooms/invite", withCORS(membershipHandler(smartcontract.ActionInvite)))
+	http.HandleFunc("/api/rooms/remove", withCORS(membershipHandler(smartcontract.ActionRemove)))
+	http.HandleFunc("/api/rooms/role", withCORS(membershipHandler(smartcontract.ActionRole)))
+	http.HandleFunc("/api/ballots", withCORS(ballotsHandler))
 	http.HandleFunc("/api/vote", withCORS(castVoteHandler))
+	http.HandleFunc("/api/weights", withCORS(setWeightsHandler))
+	http.HandleFunc("/api/delegations", withCORS(delegateHandler))
+	http.HandleFunc("/api/delegations/revoke", withCORS(revokeDelegationHandler))
+	http.HandleFunc("/api/policy", withCORS(setPolicyHandler))
+	http.HandleFunc("/api/ballots/close", withCORS(closeBallotHandler))
+	http.HandleFunc("/api/ballots/state", withCORS(transitionBallotHandler))
+	http.HandleFunc("/api/ballots/lifecycle", withCORS(getBallotStateHandler))
+	http.HandleFunc("/api/ballots/archive", withCORS(archiveHandler))
+	http.HandleFunc("/api/ballots/votes", withCORS(getBallotVotesHandler))
+	http.HandleFunc("/api/ballots/voted", withCORS(getVotedHandler))
+	http.HandleFunc("/api/outcome", withCORS(getOutcomeHandler))
 	http.HandleFunc("/api/results", withCORS(getResultsHandler))
 	http.HandleFunc("/api/ledger", withCORS(getLedgerHandler))
+	http.HandleFunc("/api/ledger/range", withCORS(getLedgerRangeHandler))
+	http.HandleFunc("/api/ledger/bundle", withCORS(bundleHandler))
+	http.HandleFunc("/api/peers", withCORS(getPeersHandler))
+
+	// Tally closed ballots and checkpoint rooms in the background
+	go runScheduler(schedulerInterval)
 
 	// Start the server
 	port := "8080"
@@ -0,0 +1,83 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"voting-blockchain/pkg/ledger"
+)
+
+// Archive ballots on POST and read archives back on GET
+func archiveHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		getArchiveHandler(w, r)
+		return
+	}
+	archiveBallotHandler(w, r)
+}
+
+// Move the votes of a tallied ballot out of the live ledger into an archive
+func archiveBallotHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		RoomID   string `json:"roomId"`
+		BallotID string `json:"ballotId"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if err := ledger.ValidRoomID(req.RoomID); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	archive, err := node.Ledgers.ArchiveBallot(req.RoomID, req.BallotID)
+	if err != nil {
+		writeArchiveError(w, err)
+		return
+	}
+	log.Printf("Archived %d blocks of ballot %s in room %s\n", archive.Blocks, req.BallotID, req.RoomID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(archive)
+}
+
+// Rehydrate the archived votes of a ballot for an audit, or list the
+// archives of a room if no ballotId is given
+func getArchiveHandler(w http.ResponseWriter, r *http.Request) {
+	roomID := r.URL.Query().Get("roomId")
+	ballotID := r.URL.Query().Get("ballotId")
+	if err := ledger.ValidRoomID(roomID); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var result interface{}
+	var err error
+	if ballotID != "" {
+		result, err = node.Ledgers.Rehydrate(roomID, ballotID)
+	} else {
+		result, err = node.Ledgers.Archives(roomID)
+	}
+	if err != nil {
+		writeArchiveError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// Report an archive failure with the matching status code
+func writeArchiveError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, ledger.ErrUnknownRoom), errors.Is(err, ledger.ErrNotArchived):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, ledger.ErrNotFinal), errors.Is(err, ledger.ErrNothingToArchive):
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
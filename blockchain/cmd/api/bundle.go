@@ -0,0 +1,80 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"voting-blockchain/pkg/ledger"
+)
+
+// maxBundleSize is the largest ledger bundle accepted for import, compressed.
+const maxBundleSize = 64 << 20
+
+// Export a room's ledger as a bundle on GET and import one on POST
+func bundleHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		exportBundleHandler(w, r)
+		return
+	}
+	importBundleHandler(w, r)
+}
+
+// Download a room's ledger as a signed bundle for auditors or another node
+func exportBundleHandler(w http.ResponseWriter, r *http.Request) {
+	roomID := r.URL.Query().Get("roomId")
+	if err := ledger.ValidRoomID(roomID); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !node.Ledgers.Hosts(roomID) {
+		http.Error(w, ledger.ErrUnknownRoom.Error(), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", roomID+".ledger.tar.gz"))
+	// Headers are sent with the first write, so a failure midway can only
+	// cut the download short; the bundle then fails verification
+	if _, err := node.Ledgers.ExportBundle(roomID, w, identity); err != nil {
+		log.Printf("Error exporting ledger of room %s: %v\n", roomID, err)
+	}
+}
+
+// Verify a ledger bundle and restore the room it holds. The bundle must be
+// signed by this node or one of the trusted bundle signers.
+func importBundleHandler(w http.ResponseWriter, r *http.Request) {
+	signers := make(map[string]bool)
+	for id := range bundleSigners {
+		signers[id] = true
+	}
+	if identity != nil {
+		signers[identity.ID()] = true
+	}
+	if len(signers) == 0 {
+		http.Error(w, "No trusted bundle signers are configured", http.StatusForbidden)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxBundleSize)
+	manifest, err := node.Ledgers.ImportBundle(r.Body, signers)
+	if err != nil {
+		if errors.Is(err, ledger.ErrInvalidBundle) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	log.Printf("Imported %d blocks of room %s\n", manifest.Blocks, manifest.RoomID)
+
+	// Keep the room in sync with peers hosting it
+	for _, peer := range node.Peers.Addrs() {
+		go node.Subscribe(peer)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(manifest)
+}
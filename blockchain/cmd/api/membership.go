@@ -0,0 +1,129 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+	"voting-blockchain/pkg/ledger"
+	"voting-blockchain/pkg/smartcontract"
+	"voting-blockchain/pkg/storage"
+)
+
+// Serializes metadata syncs so the last one always reflects the latest ledger
+var membersMu sync.Mutex
+
+// Record a membership action on a room's ledger. Join and leave are taken by
+// the user themselves; every other action names the admin taking it in "by".
+// The change must be signed by whoever takes it, with the key they joined
+// with (see smartcontract.MembershipChange.SigningBody); a join registers
+// the key in "key" and is signed with it.
+func membershipHandler(action string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			RoomID    string `json:"roomId"`
+			UserID    string `json:"userId"`
+			By        string `json:"by"`
+			Role      string `json:"role"` // for approve, invite and role
+			Key       string `json:"key"`  // for join
+			Nonce     int64  `json:"nonce"`
+			Signature string `json:"signature"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		change := smartcontract.MembershipChange{Action: action, Role: req.Role, By: req.By, Key: req.Key, Nonce: req.Nonce, Signature: req.Signature}
+		record, err := smartcontract.MembershipRecord(req.UserID, change)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		newBlock, err := addRecord(req.RoomID, record)
+		if err != nil {
+			writeRecordError(w, err)
+			return
+		}
+		syncRoomMembers(req.RoomID)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(newBlock)
+	}
+}
+
+// Get the members, requests and invitations of a room, optionally only
+// those with the given status
+func getMembersHandler(w http.ResponseWriter, r *http.Request) {
+	roomID := r.URL.Query().Get("roomId")
+	status := r.URL.Query().Get("status")
+
+	state, err := loadState(roomID)
+	if err != nil {
+		writeQueryError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(state.Members.List(status))
+}
+
+// Get the nonce the next membership change signed with a key must carry
+func getMemberNonceHandler(w http.ResponseWriter, r *http.Request) {
+	roomID := r.URL.Query().Get("roomId")
+	key := r.URL.Query().Get("key")
+	if err := ledger.ValidRoomID(roomID); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	state, err := node.Ledgers.State(roomID)
+	if err != nil {
+		writeQueryError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"roomId": roomID,
+		"key":    key,
+		"nonce":  state.Nonces[key],
+	})
+}
+
+// Mirror a room's ledger membership into its stored participants and
+// pending requests. The ledger stays the source of truth.
+func syncRoomMembers(roomID string) {
+	membersMu.Lock()
+	defer membersMu.Unlock()
+
+	room, err := roomStore.GetRoom(roomID)
+	if errors.Is(err, storage.ErrNotFound) {
+		return // Rooms learned from peers have no local metadata
+	}
+	if err != nil {
+		log.Printf("Error syncing members of room %s: %v\n", roomID, err)
+		return
+	}
+	state, err := loadState(roomID)
+	if err != nil {
+		log.Printf("Error syncing members of room %s: %v\n", roomID, err)
+		return
+	}
+	membership := state.Members
+
+	room.Participants = userIDs(membership.List(smartcontract.StatusMember))
+	room.PendingRequests = userIDs(membership.List(smartcontract.StatusPending))
+	if err := roomStore.UpdateRoom(room); err != nil {
+		log.Printf("Error syncing members of room %s: %v\n", roomID, err)
+	}
+}
+
+func userIDs(members []smartcontract.Member) []string {
+	ids := make([]string, len(members))
+	for i, member := range members {
+		ids[i] = member.UserID
+	}
+	return ids
+}
@@ -0,0 +1,167 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"voting-blockchain/pkg/block"
+	"voting-blockchain/pkg/ledger"
+	"voting-blockchain/pkg/smartcontract"
+)
+
+// ballotResults tallies a ballot from the ledger's ballot index, reading only
+// the ballot's records and the room-wide ones. Rooms bootstrapped from a
+// snapshot and ballots with archived votes are tallied from the room state
+// kept by the ledger instead, as their records no longer start at genesis.
+func ballotResults(roomID, ballotID string) (map[string]int64, error) {
+	store, err := node.Ledgers.Store(roomID)
+	if err != nil {
+		return nil, err
+	}
+	first, err := store.BlockAt(0)
+	if err != nil {
+		return nil, err
+	}
+	records, err := store.BlocksByBallot(ballotID, "")
+	if err != nil {
+		return nil, err
+	}
+	fromGenesis := first.Index == 0
+	for _, b := range records {
+		if b.Archived {
+			fromGenesis = false
+			break
+		}
+	}
+	if fromGenesis {
+		return smartcontract.TallyRecords(records, ballotID), nil
+	}
+
+	state, err := node.Ledgers.State(roomID)
+	if err != nil {
+		return nil, err
+	}
+	return state.Tally(ballotID), nil
+}
+
+// List the votes and revotes cast on a ballot in chain order, or only one
+// voter's if voterId is given
+func getBallotVotesHandler(w http.ResponseWriter, r *http.Request) {
+	roomID := r.URL.Query().Get("roomId")
+	ballotID := r.URL.Query().Get("ballotId")
+	voterID := r.URL.Query().Get("voterId")
+	if err := ledger.ValidRoomID(roomID); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if ballotID == "" {
+		http.Error(w, "ballotId is required", http.StatusBadRequest)
+		return
+	}
+
+	store, err := node.Ledgers.Store(roomID)
+	if err != nil {
+		writeQueryError(w, err)
+		return
+	}
+	votes := block.Blockchain{}
+	if voterID != "" {
+		votes, err = store.VotesBy(ballotID, voterID)
+	} else {
+		var records block.Blockchain
+		records, err = store.BlocksByBallot(ballotID)
+		for _, b := range records {
+			if b.Data.Type == block.TxVote || b.Data.Type == block.TxRevote {
+				votes = append(votes, b)
+			}
+		}
+	}
+	if err != nil {
+		writeQueryError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(votes)
+}
+
+// Report whether a voter has voted on a ballot, without reading the chain
+func getVotedHandler(w http.ResponseWriter, r *http.Request) {
+	roomID := r.URL.Query().Get("roomId")
+	ballotID := r.URL.Query().Get("ballotId")
+	voterID := r.URL.Query().Get("voterId")
+	if err := ledger.ValidRoomID(roomID); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if ballotID == "" || voterID == "" {
+		http.Error(w, "ballotId and voterId are required", http.StatusBadRequest)
+		return
+	}
+
+	store, err := node.Ledgers.Store(roomID)
+	if err != nil {
+		writeQueryError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"ballotId": ballotID,
+		"voterId":  voterID,
+		"voted":    store.HasVoted(ballotID, voterID),
+	})
+}
+
+// List the blocks of a room timestamped from "from" to "to", inclusive, in
+// Unix seconds and in timestamp order. Either bound may be left out.
+func getLedgerRangeHandler(w http.ResponseWriter, r *http.Request) {
+	roomID := r.URL.Query().Get("roomId")
+	if err := ledger.ValidRoomID(roomID); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	from, to := int64(math.MinInt64), int64(math.MaxInt64)
+	for _, bound := range []struct {
+		name  string
+		value *int64
+	}{{"from", &from}, {"to", &to}} {
+		raw := r.URL.Query().Get(bound.name)
+		if raw == "" {
+			continue
+		}
+		v, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid "+bound.name+" timestamp", http.StatusBadRequest)
+			return
+		}
+		*bound.value = v
+	}
+
+	store, err := node.Ledgers.Store(roomID)
+	if err != nil {
+		writeQueryError(w, err)
+		return
+	}
+	blocks, err := store.BlocksBetween(from, to)
+	if err != nil {
+		writeQueryError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(blocks)
+}
+
+// Report a ledger query failure with the matching status code
+func writeQueryError(w http.ResponseWriter, err error) {
+	if errors.Is(err, ledger.ErrUnknownRoom) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	log.Println(err)
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+}
@@ -0,0 +1,81 @@
+package api
+
+import (
+	"errors"
+	"log"
+	"time"
+	"voting-blockchain/pkg/smartcontract"
+	"voting-blockchain/pkg/storage"
+)
+
+// How often the scheduler checks for closed ballots and due checkpoints
+const schedulerInterval = 10 * time.Second
+
+// CheckpointInterval is the number of blocks after which the scheduler
+// commits a room's state in a checkpoint block, or 0 to never do so.
+var CheckpointInterval = 100
+
+// runScheduler periodically tallies ballots that have closed and
+// checkpoints rooms that are due. Ballots open and close by their start and
+// end times without any record, so the scheduler only appends outcomes and
+// checkpoints, and only to rooms created on this node: every other node
+// leaves them to it rather than mining competing records.
+func runScheduler(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		for _, roomID := range node.Ledgers.Rooms() {
+			if !createdHere(roomID) {
+				continue
+			}
+			tallyRoom(roomID)
+			checkpointRoom(roomID)
+		}
+	}
+}
+
+// createdHere reports whether a room was created on this node, which keeps
+// the metadata of the rooms created on it.
+func createdHere(roomID string) bool {
+	_, err := roomStore.GetRoom(roomID)
+	if err != nil && !errors.Is(err, storage.ErrNotFound) {
+		log.Printf("Scheduler: error loading room %s: %v\n", roomID, err)
+	}
+	return err == nil
+}
+
+// tallyRoom appends the outcome of every closed ballot in one room that
+// does not have one yet.
+func tallyRoom(roomID string) {
+	state, err := node.Ledgers.State(roomID)
+	if err != nil {
+		log.Printf("Scheduler: error loading room %s: %v\n", roomID, err)
+		return
+	}
+	for _, ballotID := range state.DueOutcomes(time.Now().Unix()) {
+		if _, err := appendOutcome(roomID, ballotID); err != nil {
+			log.Printf("Scheduler: ballot %s in room %s: %v\n", ballotID, roomID, err)
+			continue
+		}
+		log.Printf("Scheduler: ballot %s in room %s is now %s\n", ballotID, roomID, smartcontract.StateTallied)
+	}
+}
+
+// checkpointRoom appends a checkpoint to a room if CheckpointInterval blocks
+// have been added since the last one.
+func checkpointRoom(roomID string) {
+	state, err := node.Ledgers.State(roomID)
+	if err != nil {
+		log.Printf("Scheduler: error loading room %s: %v\n", roomID, err)
+		return
+	}
+	if !state.CheckpointDue(CheckpointInterval) {
+		return
+	}
+	newBlock, err := appendRecord(roomID, (*smartcontract.State).CheckpointRecord)
+	if err != nil {
+		log.Printf("Scheduler: checkpoint of room %s: %v\n", roomID, err)
+		return
+	}
+	log.Printf("Scheduler: room %s checkpointed at block %d\n", roomID, newBlock.Index)
+}
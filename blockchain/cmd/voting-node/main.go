@@ -3,24 +3,32 @@ package main
 import (
 	"bufio"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"io/ioutil"
+	"log"
 	"net"
 	"os"
+	"path/filepath"
 	"strings"
 	"sync"
 	"time"
 	"voting-blockchain/cmd/api" // Correct import path for the API package
 	"voting-blockchain/pkg/block"
 	"voting-blockchain/pkg/consensus"
+	"voting-blockchain/pkg/cryptography"
+	"voting-blockchain/pkg/datadir"
+	"voting-blockchain/pkg/ledger"
 	"voting-blockchain/pkg/network"
+	"voting-blockchain/pkg/storage"
 )
 
+// Port the node accepts peer connections on
+const p2pPort = "8594"
+
 var (
-	blockchain  []block.Block
-	peers       []string
 	nodeAddress string
-	mutex       sync.Mutex
+	node        *network.Node
 )
 
 // Load blockchain from a specific ledger file
@@ -130,29 +138,24 @@ func castVote(filename, ballotID, userID, choiceID string) {
 
 	// Output the new block details
 	fmt.Println("Vote casted successfully!")
-	fmt.Printf("New Block Created: Index: %d, BallotID: %s, UserID: %s, ChoiceID: %s, Hash: %s\n",
+	fmt.Printf("New Block Created: Index: %d, BallotID: %s, ChoiceID: %s, Hash: %s\n",
 		newBlock.Index, newBlock.Data.BallotID,
-		// newBlock.Data.UserID,
 		newBlock.Data.ChoiceID, newBlock.Hash)
 }
 
 func handleConnection(conn net.Conn) {
 	defer conn.Close()
-	network.HandleConnection(conn, &blockchain)
+	node.HandleConnection(conn)
 }
 
-func broadcastBlock(newBlock block.Block) {
-	for _, peer := range peers {
-		if peer != nodeAddress {
-			network.SendBlock(peer, &newBlock)
-		}
-	}
+func broadcastBlock(roomID string, newBlock block.Block) {
+	node.BroadcastBlock(roomID, &newBlock)
 }
 
 func broadcastAddr() {
-	for _, peer := range network.KnownNodes {
+	for _, peer := range node.Peers.Addrs() {
 		if peer != nodeAddress {
-			network.SendAddr(peer)
+			node.SendAddr(peer)
 		}
 	}
 }
@@ -188,13 +191,20 @@ func startNodeDiscovery(port string) {
 		}
 	}()
 
+	node.DiscoverNodes(port)
+	timeout := time.After(1 * time.Minute) // Stop after 1 minute if no nodes are found
 	for {
-		network.DiscoverNodes(port)
-		if len(network.KnownNodes) > 0 {
+		if len(node.Peers.Addrs()) > 0 {
 			loadingMutex.Lock()
 			loading = false
 			loadingMutex.Unlock()
-			fmt.Printf("\n\nDiscovered nodes: %v\n", network.KnownNodes) // Move to a new line after discovery
+			fmt.Printf("\n\nDiscovered nodes: %v\n", node.Peers.Addrs()) // Move to a new line after discovery
+			// Catch up on any blocks missed while offline
+			for _, peer := range node.Peers.Addrs() {
+				if peer != nodeAddress {
+					go node.SyncRooms(peer)
+				}
+			}
 			return
 		}
 
@@ -205,19 +215,30 @@ func startNodeDiscovery(port string) {
 			loadingMutex.Unlock()
 			fmt.Println("\nStopped scanning for nodes.") // Move to a new line after stopping
 			return
-		case <-time.After(1 * time.Minute): // Stop after 1 minute if no nodes are found
+		case <-timeout:
 			loadingMutex.Lock()
 			loading = false
 			loadingMutex.Unlock()
 			fmt.Println("\nNo nodes found on the network.") // Move to a new line after timeout
 			return
+		case <-time.After(1 * time.Second):
+		}
+	}
+}
+
+// splitList parses a comma-separated flag value.
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
 		}
 	}
+	return items
 }
 
-func startServer(port string) {
-	nodeAddress = fmt.Sprintf("%s:%s", network.GetLocalIP(), port)
-	listener, err := net.Listen("tcp", ":"+port)
+func startServer(port string, static, seeds []string, lan bool, addrBook string) {
+	listener, err := node.Listen(port)
 	if err != nil {
 		fmt.Println("Error starting server:", err)
 		return
@@ -226,8 +247,24 @@ func startServer(port string) {
 
 	fmt.Println("Server started on port", port)
 
-	// Start node discovery in a separate goroutine
-	go startNodeDiscovery(port)
+	// Remember known peers across restarts
+	if addrBook != "" {
+		if err := node.LoadAddressBook(addrBook); err != nil {
+			fmt.Println("Error loading address book:", err)
+		}
+		node.PersistAddressBook(addrBook, time.Minute)
+	}
+
+	// Keep track of peer health and reconnect to lost peers
+	node.StartHealthChecks(30 * time.Second)
+
+	// Connect to the configured peers and ask the seeds for more
+	node.Bootstrap(static, seeds)
+
+	// LAN broadcast discovery is optional outside local setups
+	if lan {
+		go startNodeDiscovery(port)
+	}
 
 	for {
 		conn, err := listener.Accept()
@@ -240,13 +277,87 @@ func startServer(port string) {
 }
 
 func main() {
-	// Initialize blockchain with genesis block
-	genesisBlock := block.CreateGenesisBlock()
-	genesisBlock.Hash = consensus.ProofOfWork(genesisBlock)
-	blockchain = append(blockchain, *genesisBlock)
+	dataDir := flag.String("datadir", ".", "directory the node keeps its ledgers, metadata, peers and key in; relative file flags are resolved inside it")
+	identityFile := flag.String("identity", "node.key", "file holding this node's identity key")
+	allowlistFile := flag.String("allowlist", "", `file of peer node IDs allowed to connect, one per line, or "open" to accept any peer`)
+	staticPeers := flag.String("peers", "", "comma-separated addresses of peers to stay connected to")
+	seedPeers := flag.String("seeds", "", "comma-separated addresses of seed nodes to learn peers from")
+	lan := flag.Bool("lan", true, "discover nodes on the local network with UDP broadcasts")
+	addrBook := flag.String("addrbook", "peers.json", "file the known peers are saved to (empty to disable)")
+	metadataDir := flag.String("metadata", "metadata", "directory room and ballot metadata is saved in (empty to keep it in memory)")
+	fastSync := flag.Bool("fastsync", false, "bootstrap rooms hosted by peers, from state snapshots for rooms with a trusted checkpoint")
+	trusted := flag.String("checkpoints", "", "comma-separated room=hash trusted checkpoints that snapshots must lead to")
+	checkpointInterval := flag.Int("checkpoint-interval", api.CheckpointInterval, "blocks between state checkpoints (0 to disable)")
+	flag.Parse()
+
+	// Relative file flags are resolved inside the data directory, which only
+	// this process may use while it runs
+	dir, err := datadir.Open(*dataDir)
+	if err != nil {
+		log.Fatalf("Error opening data directory: %v", err)
+	}
+	defer dir.Close()
+	api.CheckpointInterval = *checkpointInterval
+
+	// Set up the authenticated peer transport
+	identity, err := cryptography.LoadOrCreateIdentity(dir.Path(*identityFile))
+	if err != nil {
+		log.Fatalf("Error loading node identity: %v", err)
+	}
+	var allowlist map[string]bool
+	switch *allowlistFile {
+	case "":
+		log.Fatal(`No peer allowlist configured; pass -allowlist with a file of peer node IDs, or -allowlist=open to accept any peer`)
+	case "open":
+		fmt.Println("Warning: open mode, any node can connect.")
+	default:
+		path := dir.Path(*allowlistFile)
+		if allowlist, err = cryptography.LoadAllowlist(path); err != nil {
+			log.Fatalf("Error loading peer allowlist: %v", err)
+		}
+		if len(allowlist) == 0 {
+			log.Fatalf("Peer allowlist %s is empty; use -allowlist=open to accept any peer", path)
+		}
+	}
+	transport, err := network.NewTLSTransport(identity, allowlist)
+	if err != nil {
+		log.Fatalf("Error configuring transport: %v", err)
+	}
+	fmt.Println("Node ID:", identity.ID())
+
+	nodeAddress = fmt.Sprintf("%s:%s", network.GetLocalIP(), p2pPort)
+	node = network.NewNode(ledger.NewManager(dir.Ledgers()), transport, identity.ID(), nodeAddress)
+	node.FastSync = *fastSync
+	for _, pair := range splitList(*trusted) {
+		roomID, hash, ok := strings.Cut(pair, "=")
+		if !ok {
+			log.Fatalf("Invalid checkpoint %q, expected room=hash", pair)
+		}
+		node.TrustedCheckpoints[roomID] = hash
+	}
+	api.UseNode(node)
+	api.UseIdentity(identity)
+	api.TrustBundleSigners(allowlist)
 
 	// Start P2P server
-	go startServer("8594")
+	addrBookFile := *addrBook
+	if addrBookFile != "" {
+		addrBookFile = dir.Path(addrBookFile)
+	}
+	go startServer(p2pPort, splitList(*staticPeers), splitList(*seedPeers), *lan, addrBookFile)
+
+	// Keep room and ballot metadata across restarts
+	if *metadataDir != "" {
+		rooms, err := storage.OpenFileRoomStore(filepath.Join(dir.Path(*metadataDir), "rooms.json"))
+		if err != nil {
+			log.Fatalf("Error loading rooms: %v", err)
+		}
+		ballots, err := storage.OpenFileBallotStore(filepath.Join(dir.Path(*metadataDir), "ballots.json"))
+		if err != nil {
+			log.Fatalf("Error loading ballots: %v", err)
+		}
+		api.UseStores(rooms, ballots)
+	}
 
 	// Start the API server
 	fmt.Println("Starting the API server...")
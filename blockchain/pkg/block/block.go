@@ -7,6 +7,7 @@ import (
 	"io/ioutil"
 	"os"
 	"time"
+	"voting-blockchain/pkg/fsutil"
 )
 
 // Block structure
@@ -17,6 +18,7 @@ type Block struct {
 	PrevHash  string   `json:"prevHash"`
 	Hash      string   `json:"hash"`
 	Nonce     int      `json:"nonce"`
+	Archived  bool     `json:"archived,omitempty"` // Data moved to an archive; only BallotID, Type and VoterID are kept
 }
 
 // VoteData represents the data stored in a block
@@ -24,6 +26,40 @@ type VoteData struct {
 	BallotID string `json:"ballotId"`
 	// UserID   string `json:"userId"`
 	ChoiceID string `json:"choiceId"`
+	Type     string `json:"type,omitempty"`    // Record type, empty for a plain vote
+	VoterID  string `json:"voterId,omitempty"` // Voter the record belongs to, if any
+	Payload  string `json:"payload,omitempty"` // JSON body of non-vote records
+	// Records taken on a member's behalf are signed with the member's key
+	Signer    string `json:"signer,omitempty"`    // Member who signed the record
+	Nonce     int64  `json:"nonce,omitempty"`     // Records signed with the signer's key before
+	Signature string `json:"signature,omitempty"` // Hex signature of the record's signing body
+}
+
+// Record types stored in VoteData.Type
+const (
+	TxVote       = ""           // A vote for ChoiceID on BallotID
+	TxRevote     = "revote"     // A vote superseding VoterID's previous vote
+	TxWeights    = "weights"    // The voter weight table of a ballot
+	TxDelegate   = "delegate"   // VoterID delegates to another voter, room-wide if BallotID is empty
+	TxRevoke     = "revoke"     // VoterID revokes their delegation in the same scope
+	TxPolicy     = "policy"     // The outcome rules of a ballot
+	TxOutcome    = "outcome"    // The signed outcome of a closed ballot
+	TxState      = "state"      // A ballot lifecycle transition
+	TxMember     = "member"     // A change to VoterID's membership of the room
+	TxCheckpoint = "checkpoint" // A commitment to the room state before this block
+)
+
+// hashString renders the data for hashing. Plain votes keep the original
+// two-field format so that ledgers written before typed records still validate,
+// and unsigned records leave the signature out for the same reason.
+func (d VoteData) hashString() string {
+	if d.Type == TxVote && d.VoterID == "" && d.Payload == "" && d.Signature == "" {
+		return fmt.Sprintf("{%s %s}", d.BallotID, d.ChoiceID)
+	}
+	if d.Signature == "" {
+		return fmt.Sprintf("{%s %s %s %s %s}", d.BallotID, d.ChoiceID, d.Type, d.VoterID, d.Payload)
+	}
+	return fmt.Sprintf("{%s %s %s %s %s %s %d %s}", d.BallotID, d.ChoiceID, d.Type, d.VoterID, d.Payload, d.Signer, d.Nonce, d.Signature)
 }
 
 // Blockchain is a slice of blocks
@@ -49,19 +85,24 @@ func CreateGenesisBlock() *Block {
 		ChoiceID: "genesis"}, "0")
 }
 
-// SaveBlockchain saves the blockchain to a file
+// CreateRoomGenesisBlock creates the first block of a room's chain. The room
+// ID is recorded in it, so that records signed for one room cannot be
+// replayed in another.
+func CreateRoomGenesisBlock(roomID string) *Block {
+	genesis := CreateGenesisBlock()
+	genesis.Data.Payload = roomID
+	return genesis
+}
+
+// SaveBlockchain saves the blockchain to a file. The chain is written to a
+// temporary file that is synced and renamed over the old one, so a crash
+// leaves either the old or the new ledger, never a truncated one.
 func SaveBlockchain(filename string, blockchain Blockchain) error {
 	fileContent, err := json.MarshalIndent(blockchain, "", "  ")
 	if err != nil {
 		return err
 	}
-
-	err = ioutil.WriteFile(filename, fileContent, 0644)
-	if err != nil {
-		return err
-	}
-
-	return nil
+	return fsutil.WriteFileAtomic(filename, fileContent)
 }
 
 // LoadBlockchain loads the blockchain from a file
@@ -94,9 +135,15 @@ func ValidateBlock(b *Block) bool {
 	return true
 }
 
+// HashData identifies a record independently of the block it is mined into
+func HashData(d VoteData) string {
+	hash := sha256.Sum256([]byte(d.hashString()))
+	return fmt.Sprintf("%x", hash)
+}
+
 // CalculateHash calculates the hash of a block
 func CalculateHash(b *Block) string {
-	record := fmt.Sprintf("%d%d%v%s%d", b.Index, b.Timestamp, b.Data, b.PrevHash, b.Nonce)
+	record := fmt.Sprintf("%d%d%s%s%d", b.Index, b.Timestamp, b.Data.hashString(), b.PrevHash, b.Nonce)
 	hash := sha256.Sum256([]byte(record))
 	return fmt.Sprintf("%x", hash)
 }
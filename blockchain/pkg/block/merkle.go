@@ -0,0 +1,38 @@
+package block
+
+import (
+	"crypto/sha256"
+	"fmt"
+)
+
+// MerkleRoot returns the root of the Merkle tree over hashes, in order.
+// Each parent is the SHA-256 of its children's hex hashes concatenated; an
+// odd node out is paired with itself. The root of no hashes is empty.
+func MerkleRoot(hashes []string) string {
+	if len(hashes) == 0 {
+		return ""
+	}
+	level := append([]string(nil), hashes...)
+	for len(level) > 1 {
+		if len(level)%2 == 1 {
+			level = append(level, level[len(level)-1])
+		}
+		next := make([]string, 0, len(level)/2)
+		for i := 0; i < len(level); i += 2 {
+			next = append(next, fmt.Sprintf("%x", sha256.Sum256([]byte(level[i]+level[i+1]))))
+		}
+		level = next
+	}
+	return level[0]
+}
+
+// Stub returns the block with its data stripped down to the ballot, record
+// type and voter, as kept in the live ledger once the data is archived. The
+// voter stays so the ballot's nullifiers can still be looked up. A stub
+// cannot be checked against its hash; it is held in place by the hashes of
+// the blocks around it.
+func (b Block) Stub() Block {
+	b.Data = VoteData{BallotID: b.Data.BallotID, Type: b.Data.Type, VoterID: b.Data.VoterID}
+	b.Archived = true
+	return b
+}
@@ -5,14 +5,23 @@ import (
 	"runtime"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 	"voting-blockchain/pkg/block"
 )
 
+// Engine names the consensus rules this node validates blocks with. Peers
+// running a different engine cannot share chains.
+const Engine = "pow-sha256"
+
+// MinDifficulty is the number of leading zero hex digits every block's hash
+// must have. Nodes raise their own difficulty as mining gets faster, but
+// never below this, so every node accepts the blocks of every other.
+const MinDifficulty = 3
+
 var (
-	difficulty      = 3 // Initial difficulty
-	mutex           sync.Mutex
-	miningStartTime time.Time
+	difficulty = MinDifficulty // Initial difficulty
+	mutex      sync.Mutex
 )
 
 // adjustDifficulty dynamically adjusts the difficulty based on mining time
@@ -22,17 +31,18 @@ func adjustDifficulty(miningDuration time.Duration) {
 
 	if miningDuration < 10*time.Millisecond {
 		difficulty++
-	} else if miningDuration > 5*time.Second && difficulty > 1 {
+	} else if miningDuration > 5*time.Second && difficulty > MinDifficulty {
 		difficulty--
 	}
 }
 
 // ProofOfWork performs the Proof of Work algorithm using multi-threading
 func ProofOfWork(b *block.Block) string {
-	miningStartTime = time.Now()
+	miningStartTime := time.Now()
+	prefix := strings.Repeat("0", currentDifficulty())
 	numThreads := runtime.NumCPU()
 	var wg sync.WaitGroup
-	found := false
+	var found atomic.Bool
 	var validHash string
 	var validNonce int
 
@@ -44,13 +54,13 @@ func ProofOfWork(b *block.Block) string {
 		go func() {
 			defer wg.Done()
 			localBlock := *b // Create a local copy of the block to avoid modifying the original
-			for !found {
+			for !found.Load() {
 				localBlock.Nonce = rand.Int()
 				hash := block.CalculateHash(&localBlock)
-				if strings.HasPrefix(hash, strings.Repeat("0", difficulty)) {
+				if strings.HasPrefix(hash, prefix) {
 					mutex.Lock()
-					if !found {
-						found = true
+					if !found.Load() {
+						found.Store(true)
 						validHash = hash
 						validNonce = localBlock.Nonce
 					}
@@ -74,7 +84,16 @@ func ProofOfWork(b *block.Block) string {
 	return validHash
 }
 
-// ValidateProofOfWork checks if a block's hash meets the difficulty requirement
+// ValidateProofOfWork checks if a block's hash meets the minimum difficulty.
+// The local difficulty is not used, as it differs from node to node.
 func ValidateProofOfWork(b *block.Block) bool {
-	return strings.HasPrefix(b.Hash, strings.Repeat("0", difficulty))
+	return strings.HasPrefix(b.Hash, strings.Repeat("0", MinDifficulty))
+}
+
+// currentDifficulty returns the difficulty blocks are mined to. Blocks for
+// different rooms may be mined at the same time.
+func currentDifficulty() int {
+	mutex.Lock()
+	defer mutex.Unlock()
+	return difficulty
 }
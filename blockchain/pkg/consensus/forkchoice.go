@@ -0,0 +1,33 @@
+package consensus
+
+import (
+	"math/big"
+	"voting-blockchain/pkg/block"
+)
+
+// ForkChoice reports whether a node should switch from its current chain to
+// a candidate chain. Both chains are assumed to be structurally valid.
+type ForkChoice func(current, candidate block.Blockchain) bool
+
+// ActiveForkChoice is the rule the node uses to pick between competing chains.
+var ActiveForkChoice ForkChoice = MostWork
+
+// MostWork prefers the chain with the most cumulative proof of work. Ties
+// keep the current chain so that nodes do not flip between equal forks.
+func MostWork(current, candidate block.Blockchain) bool {
+	return ChainWork(candidate).Cmp(ChainWork(current)) > 0
+}
+
+// ChainWork sums the expected number of hashes needed to mine each block,
+// 16^n for a hash with n leading zero hex digits.
+func ChainWork(chain block.Blockchain) *big.Int {
+	total := new(big.Int)
+	for _, b := range chain {
+		zeros := 0
+		for zeros < len(b.Hash) && b.Hash[zeros] == '0' {
+			zeros++
+		}
+		total.Add(total, new(big.Int).Lsh(big.NewInt(1), uint(4*zeros)))
+	}
+	return total
+}
@@ -0,0 +1,113 @@
+package cryptography
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Identity is a node's long-term signing key. Its public key identifies the
+// node to its peers.
+type Identity struct {
+	PrivateKey ed25519.PrivateKey
+}
+
+// ID returns the node ID, the hex encoded public key.
+func (id *Identity) ID() string {
+	return KeyID(id.PrivateKey.Public().(ed25519.PublicKey))
+}
+
+// KeyID returns the hex encoding of a public key.
+func KeyID(pub ed25519.PublicKey) string {
+	return hex.EncodeToString(pub)
+}
+
+// LoadOrCreateIdentity reads the node key stored at path, generating and
+// saving a new one if the file does not exist.
+func LoadOrCreateIdentity(path string) (*Identity, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		der, err := x509.MarshalPKCS8PrivateKey(priv)
+		if err != nil {
+			return nil, err
+		}
+		pemData := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+		if err := os.WriteFile(path, pemData, 0600); err != nil {
+			return nil, err
+		}
+		return &Identity{PrivateKey: priv}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	pemBlock, _ := pem.Decode(data)
+	if pemBlock == nil {
+		return nil, fmt.Errorf("%s does not contain a PEM encoded key", path)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(pemBlock.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	priv, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s does not contain an ed25519 key", path)
+	}
+	return &Identity{PrivateKey: priv}, nil
+}
+
+// LoadAllowlist reads a file of hex encoded peer public keys, one per line.
+// Blank lines and lines starting with # are ignored.
+func LoadAllowlist(path string) (map[string]bool, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	allowed := make(map[string]bool)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, err := hex.DecodeString(line)
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid peer key %q in %s", line, path)
+		}
+		allowed[strings.ToLower(line)] = true
+	}
+	return allowed, scanner.Err()
+}
+
+// Sign signs data with the identity key and returns the hex encoded
+// signature.
+func (id *Identity) Sign(data []byte) string {
+	return hex.EncodeToString(ed25519.Sign(id.PrivateKey, data))
+}
+
+// VerifySignature checks a hex encoded signature of data by the node with
+// the given ID.
+func VerifySignature(nodeID string, data []byte, signature string) bool {
+	pub, err := hex.DecodeString(nodeID)
+	if err != nil || len(pub) != ed25519.PublicKeySize {
+		return false
+	}
+	sig, err := hex.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+	return ed25519.Verify(pub, data, sig)
+}
@@ -0,0 +1,120 @@
+// Package datadir manages the directory a node keeps its data in. The
+// directory holds the room ledgers, the room and ballot metadata, the
+// address book and the node key:
+//
+//	<root>/LOCK            held by the node process using the directory
+//	<root>/datadir.json    layout version of the directory
+//	<root>/ledgers/<room>/ one directory per hosted room (see ledger.Manager)
+//	<root>/metadata/       room and ballot metadata
+//	<root>/peers.json      address book
+//	<root>/node.key        node identity key
+//
+// Only one process may use a data directory at a time; Open takes the lock
+// and fails if another process holds it.
+package datadir
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+	"voting-blockchain/pkg/fsutil"
+)
+
+// Layout is the version of the directory layout written by this package.
+const Layout = 1
+
+const (
+	lockFile   = "LOCK"
+	infoFile   = "datadir.json"
+	ledgersDir = "ledgers"
+)
+
+// ErrLocked is returned when another process is using the data directory.
+var ErrLocked = errors.New("data directory is in use by another process")
+
+// Info is the metadata file at the root of a data directory.
+type Info struct {
+	Layout  int   `json:"layout"`
+	Created int64 `json:"created"` // Unix seconds
+}
+
+// Dir is an open, locked data directory.
+type Dir struct {
+	root string
+	lock *os.File
+}
+
+// Open creates the data directory at root if needed, locks it for this
+// process and checks that its layout is one this version understands.
+func Open(root string) (*Dir, error) {
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return nil, err
+	}
+	lock, err := acquire(filepath.Join(root, lockFile))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", root, err)
+	}
+	d := &Dir{root: root, lock: lock}
+	if err := d.checkInfo(); err != nil {
+		d.Close()
+		return nil, err
+	}
+	return d, nil
+}
+
+// Root returns the directory's path.
+func (d *Dir) Root() string {
+	return d.root
+}
+
+// Path resolves a file name from the command line against the directory.
+// Absolute paths are returned as they are.
+func (d *Dir) Path(name string) string {
+	if filepath.IsAbs(name) {
+		return name
+	}
+	return filepath.Join(d.root, name)
+}
+
+// Ledgers returns the directory the room ledgers are kept in.
+func (d *Dir) Ledgers() string {
+	return filepath.Join(d.root, ledgersDir)
+}
+
+// Close releases the lock.
+func (d *Dir) Close() error {
+	if d.lock == nil {
+		return nil
+	}
+	err := release(d.lock)
+	d.lock = nil
+	return err
+}
+
+// checkInfo writes the directory's metadata file if it is new, and refuses
+// directories written with a newer layout.
+func (d *Dir) checkInfo() error {
+	path := filepath.Join(d.root, infoFile)
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		data, err := json.MarshalIndent(Info{Layout: Layout, Created: time.Now().Unix()}, "", "  ")
+		if err != nil {
+			return err
+		}
+		return fsutil.WriteFileAtomic(path, data)
+	}
+	if err != nil {
+		return err
+	}
+	var info Info
+	if err := json.Unmarshal(data, &info); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	if info.Layout > Layout {
+		return fmt.Errorf("%s uses layout %d, newer than the supported %d", d.root, info.Layout, Layout)
+	}
+	return nil
+}
@@ -0,0 +1,32 @@
+//go:build !unix
+
+package datadir
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+// acquire creates the lock file at path, failing if it exists. Without
+// advisory locks the file outlives a crashed node and must then be removed
+// by hand.
+func acquire(path string) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	if errors.Is(err, os.ErrExist) {
+		return nil, ErrLocked
+	}
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(f, "%d\n", os.Getpid())
+	return f, nil
+}
+
+func release(f *os.File) error {
+	err := f.Close()
+	if rmErr := os.Remove(f.Name()); err == nil {
+		err = rmErr
+	}
+	return err
+}
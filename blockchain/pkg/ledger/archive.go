@@ -0,0 +1,327 @@
+package ledger
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"voting-blockchain/pkg/block"
+	"voting-blockchain/pkg/fsutil"
+	"voting-blockchain/pkg/smartcontract"
+)
+
+var (
+	// ErrNotFinal is returned for ballots that cannot be archived yet.
+	ErrNotFinal = errors.New("ballot is not final")
+	// ErrNotArchived is returned for ballots without an archive.
+	ErrNotArchived = errors.New("ballot is not archived")
+	// ErrNothingToArchive is returned for ballots whose votes are all archived.
+	ErrNothingToArchive = errors.New("nothing to archive")
+)
+
+// Archive describes the vote blocks of a ballot moved out of the live
+// ledger. The live ledger keeps a stub of each block with its header, so
+// the chain still links, and the Merkle root of the archived block hashes
+// so the archive can be checked as a whole.
+type Archive struct {
+	BallotID   string `json:"ballotId"`
+	File       string `json:"file"`       // Archive file, in the room's archive directory
+	MerkleRoot string `json:"merkleRoot"` // Root of the archived block hashes in chain order
+	Blocks     int    `json:"blocks"`
+	First      int    `json:"first"`      // Index of the first archived block
+	Last       int    `json:"last"`       // Index of the last archived block
+	Checkpoint int    `json:"checkpoint"` // Index of the checkpoint the room state is replayed from
+}
+
+// archiveDir returns the directory a room's archives are kept in.
+func (m *Manager) archiveDir(roomID string) string {
+	return filepath.Join(m.roomDir(roomID), "archive")
+}
+
+// Archives lists the archives of a room.
+func (m *Manager) Archives(roomID string) ([]Archive, error) {
+	if err := ValidRoomID(roomID); err != nil {
+		return nil, err
+	}
+	if m == nil {
+		return nil, ErrNoLedgerDir
+	}
+	var archives []Archive
+	data, err := os.ReadFile(filepath.Join(m.archiveDir(roomID), "index.json"))
+	if errors.Is(err, os.ErrNotExist) {
+		return []Archive{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &archives); err != nil {
+		return nil, fmt.Errorf("archive index of room %s: %v", roomID, err)
+	}
+	return archives, nil
+}
+
+// ArchiveBallot moves the vote and revote blocks of a final ballot to a
+// compressed archive, leaving stubs in the live ledger. A ballot is final
+// once its outcome is recorded and followed by a checkpoint; the room state
+// is replayed from that checkpoint from then on, so no rule needs the
+// archived votes again. Its weights, policy, state and outcome records stay
+// in the live ledger.
+func (m *Manager) ArchiveBallot(roomID, ballotID string) (Archive, error) {
+	r, err := m.room(roomID, false)
+	if err != nil {
+		return Archive{}, err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := m.open(r, roomID); err != nil {
+		return Archive{}, err
+	}
+	chain := r.snapshot()
+
+	outcome, checkpoint := -1, smartcontract.LatestCheckpoint(chain)
+	var positions []int
+	for i, b := range chain {
+		if b.Data.BallotID != ballotID || b.Archived {
+			continue
+		}
+		switch b.Data.Type {
+		case block.TxOutcome:
+			if outcome < 0 {
+				outcome = i
+			}
+		case block.TxVote, block.TxRevote:
+			positions = append(positions, i)
+		}
+	}
+	if outcome < 0 {
+		return Archive{}, fmt.Errorf("%w: ballot %s has no outcome", ErrNotFinal, ballotID)
+	}
+	if checkpoint < outcome {
+		return Archive{}, fmt.Errorf("%w: no checkpoint follows the outcome of ballot %s", ErrNotFinal, ballotID)
+	}
+	if len(positions) == 0 {
+		return Archive{}, fmt.Errorf("%w: ballot %s has no votes left in the live ledger", ErrNothingToArchive, ballotID)
+	}
+	if positions[len(positions)-1] > checkpoint {
+		return Archive{}, fmt.Errorf("%w: ballot %s has votes after checkpoint %d", ErrNotFinal, ballotID, chain[checkpoint].Index)
+	}
+	state, err := smartcontract.StateAt(chain, checkpoint)
+	if err != nil {
+		return Archive{}, err
+	}
+
+	archived := make(block.Blockchain, len(positions))
+	hashes := make([]string, len(positions))
+	for i, pos := range positions {
+		archived[i] = chain[pos]
+		hashes[i] = chain[pos].Hash
+	}
+	a := Archive{
+		BallotID:   ballotID,
+		MerkleRoot: block.MerkleRoot(hashes),
+		Blocks:     len(archived),
+		First:      archived[0].Index,
+		Last:       archived[len(archived)-1].Index,
+		Checkpoint: chain[checkpoint].Index,
+	}
+	a.File = a.MerkleRoot + ".jsonl.gz"
+
+	// The archive and the snapshot are durable before any block is stubbed,
+	// so an interrupted archival leaves the live ledger as it was
+	archives, err := m.Archives(roomID)
+	if err != nil {
+		return Archive{}, err
+	}
+	dir := m.archiveDir(roomID)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return Archive{}, err
+	}
+	if err := writeArchive(filepath.Join(dir, a.File), archived); err != nil {
+		return Archive{}, err
+	}
+	index := []Archive{a}
+	for _, other := range archives {
+		if other.File != a.File {
+			index = append(index, other)
+		}
+	}
+	data, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return Archive{}, err
+	}
+	if err := fsutil.WriteFileAtomic(filepath.Join(dir, "index.json"), data); err != nil {
+		return Archive{}, err
+	}
+	if err := m.saveSnapshot(r, roomID, state); err != nil {
+		return Archive{}, err
+	}
+
+	next := append(block.Blockchain(nil), chain[positions[0]:]...)
+	for _, pos := range positions {
+		next[pos-positions[0]] = chain[pos].Stub()
+	}
+	if err := r.store.Replace(positions[0], next); err != nil {
+		return Archive{}, err
+	}
+	r.chain = append(append(block.Blockchain(nil), chain[:positions[0]]...), next...)
+	return a, nil
+}
+
+// Rehydrate reads back the archived blocks of a ballot for an audit. Every
+// block is checked against its hash and the stub in the live ledger, and
+// each archive against its Merkle root.
+func (m *Manager) Rehydrate(roomID, ballotID string) (block.Blockchain, error) {
+	store, err := m.Store(roomID)
+	if err != nil {
+		return nil, err
+	}
+	archives, err := m.Archives(roomID)
+	if err != nil {
+		return nil, err
+	}
+
+	var blocks block.Blockchain
+	found := false
+	for _, a := range archives {
+		if a.BallotID != ballotID {
+			continue
+		}
+		found = true
+		archived, err := m.readArchive(roomID, a, store)
+		if err != nil {
+			return nil, err
+		}
+		blocks = append(blocks, archived...)
+	}
+	if !found {
+		return nil, fmt.Errorf("%w: ballot %s of room %s", ErrNotArchived, ballotID, roomID)
+	}
+	return blocks, nil
+}
+
+// Restore returns a copy of blocks with archived stubs replaced by the
+// blocks they stand for, so they can be sent to peers that validate them.
+func (m *Manager) Restore(roomID string, blocks block.Blockchain) (block.Blockchain, error) {
+	restored := append(block.Blockchain(nil), blocks...)
+	var full map[string]block.Block // Archived blocks by hash, read on first use
+	for i, b := range restored {
+		if !b.Archived {
+			continue
+		}
+		if full == nil {
+			store, err := m.Store(roomID)
+			if err != nil {
+				return nil, err
+			}
+			if full, err = m.archivedBlocks(roomID, store); err != nil {
+				return nil, err
+			}
+		}
+		original, ok := full[b.Hash]
+		if !ok {
+			return nil, fmt.Errorf("archive of block %d in room %s is missing", b.Index, roomID)
+		}
+		restored[i] = original
+	}
+	return restored, nil
+}
+
+// archivedBlocks reads every archive of a room, by block hash.
+func (m *Manager) archivedBlocks(roomID string, store LedgerStore) (map[string]block.Block, error) {
+	archives, err := m.Archives(roomID)
+	if err != nil {
+		return nil, err
+	}
+	full := make(map[string]block.Block)
+	for _, a := range archives {
+		archived, err := m.readArchive(roomID, a, store)
+		if err != nil {
+			return nil, err
+		}
+		for _, b := range archived {
+			full[b.Hash] = b
+		}
+	}
+	return full, nil
+}
+
+// checkStubs verifies the archived stubs of a room's chain: each must stand
+// for a block in one of the room's archives and keep every field of that
+// block except the data the stub drops.
+func (m *Manager) checkStubs(roomID string, chain block.Blockchain, store LedgerStore) error {
+	var full map[string]block.Block // Read on first use
+	for _, b := range chain {
+		if !b.Archived {
+			continue
+		}
+		if full == nil {
+			var err error
+			if full, err = m.archivedBlocks(roomID, store); err != nil {
+				return err
+			}
+		}
+		original, ok := full[b.Hash]
+		if !ok {
+			return fmt.Errorf("block %d is archived but in no archive", b.Index)
+		}
+		if original.Stub() != b {
+			return fmt.Errorf("stub of block %d does not match its archived block", b.Index)
+		}
+	}
+	return nil
+}
+
+// readArchive reads an archive and verifies it against the live ledger.
+func (m *Manager) readArchive(roomID string, a Archive, store LedgerStore) (block.Blockchain, error) {
+	f, err := os.Open(filepath.Join(m.archiveDir(roomID), filepath.Base(a.File)))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, fmt.Errorf("archive %s: %v", a.File, err)
+	}
+	defer zr.Close()
+
+	var blocks block.Blockchain
+	var hashes []string
+	dec := json.NewDecoder(zr)
+	for dec.More() {
+		var b block.Block
+		if err := dec.Decode(&b); err != nil {
+			return nil, fmt.Errorf("archive %s: %v", a.File, err)
+		}
+		if b.Archived || !block.ValidateBlock(&b) {
+			return nil, fmt.Errorf("archive %s: block %d has been tampered with", a.File, b.Index)
+		}
+		stub, err := store.BlockByHash(b.Hash)
+		if err != nil || stub.Index != b.Index || stub.Data.BallotID != b.Data.BallotID {
+			return nil, fmt.Errorf("archive %s: block %d is not in the ledger", a.File, b.Index)
+		}
+		blocks = append(blocks, b)
+		hashes = append(hashes, b.Hash)
+	}
+	if len(blocks) != a.Blocks || block.MerkleRoot(hashes) != a.MerkleRoot {
+		return nil, fmt.Errorf("archive %s does not match its Merkle root", a.File)
+	}
+	return blocks, nil
+}
+
+// writeArchive writes blocks as gzipped JSON lines, atomically so the
+// archive is either complete or absent.
+func writeArchive(path string, blocks block.Blockchain) error {
+	return fsutil.WriteAtomic(path, func(w io.Writer) error {
+		zw := gzip.NewWriter(w)
+		enc := json.NewEncoder(zw)
+		for _, b := range blocks {
+			if err := enc.Encode(b); err != nil {
+				return err
+			}
+		}
+		return zw.Close()
+	})
+}
@@ -0,0 +1,381 @@
+package ledger
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+	"voting-blockchain/pkg/block"
+	"voting-blockchain/pkg/consensus"
+	"voting-blockchain/pkg/cryptography"
+	"voting-blockchain/pkg/smartcontract"
+)
+
+// BundleFormat identifies ledger bundles and the version of their layout.
+const BundleFormat = "voting-ledger-bundle/1"
+
+// Files of a ledger bundle, a gzipped tar archive holding them in this order.
+// The state file is only present for chains that start at a checkpoint.
+const (
+	manifestFile = "manifest.json"
+	blocksFile   = "blocks.jsonl"
+	stateFile    = "state.json"
+)
+
+// maxBundleFile is the largest uncompressed file a bundle may hold, so a
+// small compressed bundle cannot expand without bound while it is read.
+const maxBundleFile = 256 << 20
+
+// ErrInvalidBundle is returned for bundles that fail verification.
+var ErrInvalidBundle = errors.New("invalid ledger bundle")
+
+// Manifest describes a ledger bundle: a room's chain exported for auditors
+// or to restore on another node. It commits to every other file of the
+// bundle by its SHA-256 and to the chain by its tip and the Merkle root of
+// its block hashes, and it may be signed by the exporting node, so a bundle
+// can be verified end to end without the node that wrote it.
+type Manifest struct {
+	Format     string            `json:"format"`
+	RoomID     string            `json:"roomId"`
+	ExportedAt int64             `json:"exportedAt"`
+	Encoding   string            `json:"encoding"` // Encoding of the blocks file, JSON Lines
+	Blocks     int               `json:"blocks"`
+	First      int               `json:"first"`      // Index of the first block
+	Tip        string            `json:"tip"`        // Hash of the last block
+	MerkleRoot string            `json:"merkleRoot"` // Root of the block hashes in chain order
+	StateRoot  string            `json:"stateRoot,omitempty"`
+	Files      map[string]string `json:"files"`               // SHA-256 of each other file, hex
+	Signer     string            `json:"signer,omitempty"`    // ID of the node that signed the manifest
+	Signature  string            `json:"signature,omitempty"` // Signature of the manifest without it
+}
+
+// Bundle is the verified content of a ledger bundle.
+type Bundle struct {
+	Manifest Manifest
+	Blocks   block.Blockchain
+	State    *smartcontract.State // State before Blocks[0], nil for chains from genesis
+}
+
+// signedBytes returns the encoding of the manifest the signature covers.
+func (mf Manifest) signedBytes() ([]byte, error) {
+	mf.Signature = ""
+	return json.Marshal(mf)
+}
+
+// ExportBundle writes a room's chain to w as a ledger bundle, signed by
+// signer unless it is nil. Archived blocks are restored from their archives,
+// so every block in the bundle can be checked against its hash.
+func (m *Manager) ExportBundle(roomID string, w io.Writer, signer *cryptography.Identity) (Manifest, error) {
+	chain, err := m.Chain(roomID)
+	if err != nil {
+		return Manifest{}, err
+	}
+	chain, err = m.Restore(roomID, chain)
+	if err != nil {
+		return Manifest{}, err
+	}
+
+	files := make(map[string][]byte)
+	var blocks bytes.Buffer
+	enc := json.NewEncoder(&blocks)
+	hashes := make([]string, len(chain))
+	for i, b := range chain {
+		if err := enc.Encode(b); err != nil {
+			return Manifest{}, err
+		}
+		hashes[i] = b.Hash
+	}
+	files[blocksFile] = blocks.Bytes()
+
+	mf := Manifest{
+		Format:     BundleFormat,
+		RoomID:     roomID,
+		ExportedAt: time.Now().Unix(),
+		Encoding:   "jsonl",
+		Blocks:     len(chain),
+		First:      chain[0].Index,
+		Tip:        chain[len(chain)-1].Hash,
+		MerkleRoot: block.MerkleRoot(hashes),
+		Files:      make(map[string]string),
+	}
+	if chain[0].Index != 0 {
+		// The chain starts at a checkpoint, so it comes with the snapshot
+		// of the state that checkpoint commits to
+		state, err := smartcontract.StateAt(chain, 0)
+		if err != nil {
+			return Manifest{}, err
+		}
+		if files[stateFile], err = json.Marshal(state); err != nil {
+			return Manifest{}, err
+		}
+		if mf.StateRoot, err = state.Root(); err != nil {
+			return Manifest{}, err
+		}
+	}
+	for name, data := range files {
+		mf.Files[name] = digest(data)
+	}
+	if signer != nil {
+		mf.Signer = signer.ID()
+		signed, err := mf.signedBytes()
+		if err != nil {
+			return Manifest{}, err
+		}
+		mf.Signature = signer.Sign(signed)
+	}
+	manifest, err := json.MarshalIndent(mf, "", "  ")
+	if err != nil {
+		return Manifest{}, err
+	}
+
+	zw := gzip.NewWriter(w)
+	tw := tar.NewWriter(zw)
+	for _, f := range []struct {
+		name string
+		data []byte
+	}{{manifestFile, manifest}, {blocksFile, files[blocksFile]}, {stateFile, files[stateFile]}} {
+		if f.data == nil {
+			continue
+		}
+		header := &tar.Header{Name: f.name, Mode: 0644, Size: int64(len(f.data)), ModTime: time.Unix(mf.ExportedAt, 0)}
+		if err := tw.WriteHeader(header); err != nil {
+			return Manifest{}, err
+		}
+		if _, err := tw.Write(f.data); err != nil {
+			return Manifest{}, err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return Manifest{}, err
+	}
+	return mf, zw.Close()
+}
+
+// ReadBundle reads a ledger bundle and verifies it end to end: the manifest
+// signature if it has one, the digest of every file, each block against its
+// hash, predecessor and the proof-of-work target, the chain against the
+// manifest's tip and Merkle root, the state snapshot of a chain starting at
+// a checkpoint against that checkpoint, and every record against the state
+// before it. If signers is not empty, the bundle must be signed by one of
+// them.
+func ReadBundle(r io.Reader, signers map[string]bool) (*Bundle, error) {
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidBundle, err)
+	}
+	defer zr.Close()
+	files := make(map[string][]byte)
+	tr := tar.NewReader(zr)
+	for {
+		header, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidBundle, err)
+		}
+		switch header.Name {
+		case manifestFile, blocksFile, stateFile:
+		default:
+			return nil, fmt.Errorf("%w: unexpected file %s", ErrInvalidBundle, header.Name)
+		}
+		if _, dup := files[header.Name]; dup {
+			return nil, fmt.Errorf("%w: %s appears twice", ErrInvalidBundle, header.Name)
+		}
+		if header.Size > maxBundleFile {
+			return nil, fmt.Errorf("%w: %s is larger than %d bytes", ErrInvalidBundle, header.Name, maxBundleFile)
+		}
+		if files[header.Name], err = io.ReadAll(tr); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidBundle, err)
+		}
+	}
+
+	var mf Manifest
+	if err := json.Unmarshal(files[manifestFile], &mf); err != nil {
+		return nil, fmt.Errorf("%w: manifest: %v", ErrInvalidBundle, err)
+	}
+	if err := verifyManifest(mf, files, signers); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidBundle, err)
+	}
+	bundle := &Bundle{Manifest: mf}
+	if bundle.Blocks, err = decodeBundleBlocks(files[blocksFile]); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidBundle, err)
+	}
+	if err := bundle.verifyChain(files[stateFile]); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidBundle, err)
+	}
+	return bundle, nil
+}
+
+// ImportBundle verifies a ledger bundle and restores the room it holds. A
+// room the node already hosts is only replaced by a chain that holds the
+// room's first block and wins fork choice against the room's chain, as a
+// chain from a peer would have to. A chain starting at a checkpoint can only
+// be imported into a room the node does not host yet.
+func (m *Manager) ImportBundle(r io.Reader, signers map[string]bool) (Manifest, error) {
+	bundle, err := ReadBundle(r, signers)
+	if err != nil {
+		return Manifest{}, err
+	}
+	roomID := bundle.Manifest.RoomID
+	if bundle.State != nil {
+		return bundle.Manifest, m.Bootstrap(roomID, bundle.State, bundle.Blocks)
+	}
+	return bundle.Manifest, m.Update(roomID, func(current block.Blockchain) (block.Blockchain, error) {
+		if current == nil {
+			return bundle.Blocks, nil
+		}
+		base := -1
+		for i := range bundle.Blocks {
+			if bundle.Blocks[i].Hash == current[0].Hash {
+				base = i
+				break
+			}
+		}
+		if base < 0 {
+			return nil, fmt.Errorf("room %s has a different chain than the bundle", roomID)
+		}
+		candidate := bundle.Blocks[base:]
+		if !consensus.ActiveForkChoice(current, candidate) {
+			return nil, fmt.Errorf("bundle does not improve on the chain of room %s", roomID)
+		}
+		return candidate, nil
+	})
+}
+
+func verifyManifest(mf Manifest, files map[string][]byte, signers map[string]bool) error {
+	if mf.Format != BundleFormat {
+		return fmt.Errorf("unsupported format %q", mf.Format)
+	}
+	if mf.Encoding != "jsonl" {
+		return fmt.Errorf("unsupported block encoding %q", mf.Encoding)
+	}
+	if err := ValidRoomID(mf.RoomID); err != nil {
+		return err
+	}
+	if mf.Signature != "" {
+		signed, err := mf.signedBytes()
+		if err != nil {
+			return err
+		}
+		if !cryptography.VerifySignature(mf.Signer, signed, mf.Signature) {
+			return errors.New("manifest signature does not verify")
+		}
+	}
+	if len(signers) > 0 && (mf.Signature == "" || !signers[mf.Signer]) {
+		return errors.New("bundle is not signed by a trusted node")
+	}
+
+	if _, ok := mf.Files[blocksFile]; !ok {
+		return fmt.Errorf("manifest does not list %s", blocksFile)
+	}
+	for name, data := range files {
+		if name == manifestFile {
+			continue
+		}
+		sum, ok := mf.Files[name]
+		if !ok {
+			return fmt.Errorf("%s is not listed in the manifest", name)
+		}
+		if digest(data) != sum {
+			return fmt.Errorf("%s does not match its digest", name)
+		}
+	}
+	for name := range mf.Files {
+		if _, ok := files[name]; !ok {
+			return fmt.Errorf("%s is missing", name)
+		}
+	}
+	return nil
+}
+
+func decodeBundleBlocks(data []byte) (block.Blockchain, error) {
+	var chain block.Blockchain
+	dec := json.NewDecoder(bytes.NewReader(data))
+	for dec.More() {
+		var b block.Block
+		if err := dec.Decode(&b); err != nil {
+			return nil, fmt.Errorf("%s: %v", blocksFile, err)
+		}
+		chain = append(chain, b)
+	}
+	return chain, nil
+}
+
+// verifyChain checks the bundle's blocks against the manifest and decodes
+// and checks the state snapshot they start from, if any.
+func (b *Bundle) verifyChain(state []byte) error {
+	mf, chain := b.Manifest, b.Blocks
+	if len(chain) == 0 || len(chain) != mf.Blocks {
+		return fmt.Errorf("manifest lists %d blocks, the bundle holds %d", mf.Blocks, len(chain))
+	}
+	hashes := make([]string, len(chain))
+	for i := range chain {
+		var prev *block.Block
+		if i > 0 {
+			prev = &chain[i-1]
+		}
+		if chain[i].Archived {
+			return fmt.Errorf("block %d is archived", chain[i].Index)
+		}
+		if err := checkLink(prev, &chain[i]); err != nil {
+			return err
+		}
+		hashes[i] = chain[i].Hash
+	}
+	if chain[0].Index != mf.First || chain[len(chain)-1].Hash != mf.Tip || block.MerkleRoot(hashes) != mf.MerkleRoot {
+		return errors.New("blocks do not match the manifest")
+	}
+
+	if chain[0].Index == 0 {
+		if chain[0].PrevHash != "0" || state != nil {
+			return errors.New("chain from genesis must start with a genesis block and no snapshot")
+		}
+		return validateRecords(smartcontract.NewState(), chain)
+	}
+	if state == nil {
+		return fmt.Errorf("chain starting at block %d has no snapshot", chain[0].Index)
+	}
+	s, err := smartcontract.DecodeState(state)
+	if err != nil {
+		return fmt.Errorf("%s: %v", stateFile, err)
+	}
+	if root, err := s.Root(); err != nil || root != mf.StateRoot {
+		return errors.New("snapshot does not match the manifest's state root")
+	}
+	if err := smartcontract.VerifySnapshot(s, chain[0]); err != nil {
+		return err
+	}
+	if err := validateRecords(s.Clone(), chain); err != nil {
+		return err
+	}
+	b.State = s
+	return nil
+}
+
+// validateRecords replays a chain from the state before it, checking each
+// block's proof of work and record against the state so far.
+func validateRecords(state *smartcontract.State, chain block.Blockchain) error {
+	for _, b := range chain {
+		if !consensus.ValidateProofOfWork(&b) {
+			return fmt.Errorf("block %d does not meet the proof-of-work target", b.Index)
+		}
+		if err := state.Validate(b.Data, b.Timestamp); err != nil {
+			return fmt.Errorf("block %d: %v", b.Index, err)
+		}
+		state.Apply(b)
+	}
+	return nil
+}
+
+// digest returns the hex SHA-256 of data.
+func digest(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
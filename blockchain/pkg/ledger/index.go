@@ -0,0 +1,147 @@
+package ledger
+
+import (
+	"sort"
+	"voting-blockchain/pkg/block"
+)
+
+// storeIndex holds the secondary indexes of a FileStore in memory. They are
+// built while the chain is verified on open and updated with every change,
+// so queries by ballot, voter or time read only the blocks they return.
+type storeIndex struct {
+	byBallot map[string][]int  // Heights of each ballot's records; room-wide records under ""
+	byVoter  map[voteKey][]int // Heights of each named voter's votes and revotes on a ballot
+	byTime   []timeEntry       // Every height, ordered by timestamp and then height
+}
+
+// voteKey is a voter on a ballot: the nullifier of their vote.
+type voteKey struct {
+	ballotID string
+	voterID  string
+}
+
+type timeEntry struct {
+	timestamp int64
+	height    int
+}
+
+func newStoreIndex() storeIndex {
+	return storeIndex{
+		byBallot: make(map[string][]int),
+		byVoter:  make(map[voteKey][]int),
+	}
+}
+
+// add indexes the block at a height above every indexed one.
+func (x *storeIndex) add(height int, b *block.Block) {
+	x.byBallot[b.Data.BallotID] = append(x.byBallot[b.Data.BallotID], height)
+	if (b.Data.Type == block.TxVote || b.Data.Type == block.TxRevote) && b.Data.VoterID != "" {
+		key := voteKey{b.Data.BallotID, b.Data.VoterID}
+		x.byVoter[key] = append(x.byVoter[key], height)
+	}
+
+	// Blocks are mostly appended in time order, so this is usually the end
+	i := sort.Search(len(x.byTime), func(i int) bool { return x.byTime[i].timestamp > b.Timestamp })
+	x.byTime = append(x.byTime, timeEntry{})
+	copy(x.byTime[i+1:], x.byTime[i:])
+	x.byTime[i] = timeEntry{timestamp: b.Timestamp, height: height}
+}
+
+// truncate drops the blocks from height n on.
+func (x *storeIndex) truncate(n int) {
+	for ballotID, heights := range x.byBallot {
+		if heights = trimHeights(heights, n); len(heights) == 0 {
+			delete(x.byBallot, ballotID)
+		} else {
+			x.byBallot[ballotID] = heights
+		}
+	}
+	for key, heights := range x.byVoter {
+		if heights = trimHeights(heights, n); len(heights) == 0 {
+			delete(x.byVoter, key)
+		} else {
+			x.byVoter[key] = heights
+		}
+	}
+	kept := x.byTime[:0]
+	for _, e := range x.byTime {
+		if e.height < n {
+			kept = append(kept, e)
+		}
+	}
+	x.byTime = kept
+}
+
+// between returns the heights of the blocks timestamped from from to to,
+// inclusive, in timestamp order.
+func (x *storeIndex) between(from, to int64) []int {
+	start := sort.Search(len(x.byTime), func(i int) bool { return x.byTime[i].timestamp >= from })
+	var heights []int
+	for _, e := range x.byTime[start:] {
+		if e.timestamp > to {
+			break
+		}
+		heights = append(heights, e.height)
+	}
+	return heights
+}
+
+// trimHeights drops the heights from n on from an ascending list.
+func trimHeights(heights []int, n int) []int {
+	return heights[:sort.SearchInts(heights, n)]
+}
+
+// mergeHeights merges ascending lists of heights into one.
+func mergeHeights(lists ...[]int) []int {
+	var merged []int
+	for _, heights := range lists {
+		merged = append(merged, heights...)
+	}
+	sort.Ints(merged)
+	return merged
+}
+
+func (s *FileStore) BlocksByBallot(ballotIDs ...string) (block.Blockchain, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	lists := make([][]int, 0, len(ballotIDs))
+	seen := make(map[string]bool)
+	for _, ballotID := range ballotIDs {
+		if !seen[ballotID] {
+			seen[ballotID] = true
+			lists = append(lists, s.index.byBallot[ballotID])
+		}
+	}
+	return s.readHeights(mergeHeights(lists...))
+}
+
+func (s *FileStore) VotesBy(ballotID, voterID string) (block.Blockchain, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.readHeights(s.index.byVoter[voteKey{ballotID, voterID}])
+}
+
+func (s *FileStore) HasVoted(ballotID, voterID string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.index.byVoter[voteKey{ballotID, voterID}]) > 0
+}
+
+func (s *FileStore) BlocksBetween(from, to int64) (block.Blockchain, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.readHeights(s.index.between(from, to))
+}
+
+// readHeights reads the blocks at heights, in that order.
+func (s *FileStore) readHeights(heights []int) (block.Blockchain, error) {
+	blocks := make(block.Blockchain, 0, len(heights))
+	for _, height := range heights {
+		b, err := s.read(s.entries[height])
+		if err != nil {
+			return nil, err
+		}
+		blocks = append(blocks, b)
+	}
+	return blocks, nil
+}
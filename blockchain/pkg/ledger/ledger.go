@@ -0,0 +1,694 @@
+package ledger
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"voting-blockchain/pkg/block"
+	"voting-blockchain/pkg/fsutil"
+	"voting-blockchain/pkg/smartcontract"
+)
+
+var (
+	// ErrUnknownRoom is returned for rooms the node does not host.
+	ErrUnknownRoom = errors.New("room is not hosted by this node")
+	// ErrNoLedgerDir is returned by a nil Manager, which stands for a node
+	// whose ledger directory is not set up yet.
+	ErrNoLedgerDir = errors.New("no ledger directory is configured")
+	// ErrInvalidRoomID is returned for room IDs that are not safe to use in
+	// file names.
+	ErrInvalidRoomID = errors.New("invalid room id")
+	// ErrBusy is returned by Extend when the room kept changing while its
+	// block was built. Nothing was added, and the caller may try again.
+	ErrBusy = errors.New("room kept changing while the block was built")
+)
+
+// roomIDPattern restricts room IDs to letters, digits, '-' and '_' so they
+// can never name a path outside the ledger directory.
+var roomIDPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_-]{0,127}$`)
+
+// ValidRoomID reports whether a room ID is well formed.
+func ValidRoomID(roomID string) error {
+	if !roomIDPattern.MatchString(roomID) {
+		return fmt.Errorf("%w %q", ErrInvalidRoomID, roomID)
+	}
+	return nil
+}
+
+// Manager gives room-keyed access to the ledgers hosted by a node. Each
+// room's chain is kept in its own LedgerStore and cached in memory once
+// opened. Changes to a room are serialized by a per-room lock, so rooms
+// never block each other and a block built from a room's chain can never be
+// lost to a concurrent append.
+//
+// Every room has a directory of its own under the manager's directory:
+//
+//	<room>/room.json   metadata, written once the store holds the room's chain
+//	<room>/ledger.*    the store's log, index and WAL (see FileStore)
+//	<room>/state.snap  the snapshot the chain is replayed from, if any
+//	<room>/archive/    archived ballots (see ArchiveBallot)
+//
+// A room bootstrapped from a snapshot starts its chain at the checkpoint the
+// snapshot was verified against. Archiving a ballot likewise keeps a
+// snapshot at the checkpoint following it.
+//
+// Stores kept directly in the manager's directory (<room>.idx and so on) are
+// moved into the room's directory, and ledgers in the older JSON format
+// (blockchain-<room>.json) imported, the first time they are used; JSON is
+// otherwise only an import/export format.
+type Manager struct {
+	dir   string
+	mu    sync.Mutex // Guards rooms
+	rooms map[string]*roomLedger
+}
+
+// roomLedger is the open ledger of one room.
+type roomLedger struct {
+	build sync.Mutex // Serializes Extend, which builds blocks without holding mu
+	mu    sync.Mutex
+	store LedgerStore          // nil until opened
+	chain block.Blockchain     // Cached copy of the store's chain
+	state *smartcontract.State // State after chain, nil until first needed
+	floor int                  // Index of the block the room's snapshot precedes, 0 without one
+}
+
+// RoomLayout is the version of the room directory layout.
+const RoomLayout = 1
+
+// RoomInfo is the metadata file of a room's directory. The room is hosted
+// once the file exists.
+type RoomInfo struct {
+	RoomID  string `json:"roomId"`
+	Layout  int    `json:"layout"`
+	Created int64  `json:"created"` // When the node started hosting the room, Unix seconds
+}
+
+// maxExtendAttempts bounds how often Extend rebuilds a block because the
+// chain moved while it was being built.
+const maxExtendAttempts = 5
+
+// NewManager creates a manager for the ledgers stored in dir.
+func NewManager(dir string) *Manager {
+	return &Manager{dir: dir, rooms: make(map[string]*roomLedger)}
+}
+
+// jsonPath returns the legacy JSON ledger file of a room.
+func (m *Manager) jsonPath(roomID string) string {
+	return filepath.Join(m.dir, fmt.Sprintf("blockchain-%s.json", roomID))
+}
+
+// roomDir returns the directory a room's files are kept in. Before rooms
+// had directories of their own, the store files were named after it, as
+// <roomDir>.idx and so on; room IDs never contain dots, so those names
+// cannot be taken by a room's directory.
+func (m *Manager) roomDir(roomID string) string {
+	return filepath.Join(m.dir, roomID)
+}
+
+// storeBase returns the path a room's store files are named after.
+func (m *Manager) storeBase(roomID string) string {
+	return filepath.Join(m.roomDir(roomID), "ledger")
+}
+
+// snapshotPath returns the file a room's snapshot is kept in.
+func (m *Manager) snapshotPath(roomID string) string {
+	return filepath.Join(m.roomDir(roomID), "state.snap")
+}
+
+// infoPath returns the metadata file of a room.
+func (m *Manager) infoPath(roomID string) string {
+	return filepath.Join(m.roomDir(roomID), "room.json")
+}
+
+// Rooms lists the rooms hosted by the node.
+func (m *Manager) Rooms() []string {
+	if m == nil {
+		return nil
+	}
+	seen := make(map[string]bool)
+	for _, pattern := range []string{m.infoPath("*"), m.jsonPath("*"), m.roomDir("*") + ".idx"} {
+		files, err := filepath.Glob(pattern)
+		if err != nil {
+			continue
+		}
+		for _, file := range files {
+			name := filepath.Base(file)
+			if name == "room.json" {
+				name = filepath.Base(filepath.Dir(file))
+			}
+			name = strings.TrimSuffix(strings.TrimSuffix(strings.TrimPrefix(name, "blockchain-"), ".json"), ".idx")
+			if ValidRoomID(name) == nil {
+				seen[name] = true
+			}
+		}
+	}
+	rooms := make([]string, 0, len(seen))
+	for roomID := range seen {
+		rooms = append(rooms, roomID)
+	}
+	sort.Strings(rooms)
+	return rooms
+}
+
+// Hosts reports whether the node keeps a ledger for a room.
+func (m *Manager) Hosts(roomID string) bool {
+	return m != nil && ValidRoomID(roomID) == nil && m.onDisk(roomID)
+}
+
+// Info returns the metadata of a hosted room.
+func (m *Manager) Info(roomID string) (RoomInfo, error) {
+	r, err := m.room(roomID, false)
+	if err != nil {
+		return RoomInfo{}, err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := m.open(r, roomID); err != nil {
+		return RoomInfo{}, err
+	}
+	return readRoomInfo(m.infoPath(roomID))
+}
+
+// Store returns the store of a room, for lookups by height or hash.
+func (m *Manager) Store(roomID string) (LedgerStore, error) {
+	r, err := m.room(roomID, false)
+	if err != nil {
+		return nil, err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := m.open(r, roomID); err != nil {
+		return nil, err
+	}
+	return r.store, nil
+}
+
+// Chain returns a room's chain. The chain is shared with the cache and must
+// not be modified.
+func (m *Manager) Chain(roomID string) (block.Blockchain, error) {
+	r, err := m.room(roomID, false)
+	if err != nil {
+		return nil, err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := m.open(r, roomID); err != nil {
+		return nil, err
+	}
+	return r.snapshot(), nil
+}
+
+// State returns a copy of the state of a room after its chain.
+func (m *Manager) State(roomID string) (*smartcontract.State, error) {
+	r, err := m.room(roomID, false)
+	if err != nil {
+		return nil, err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := m.open(r, roomID); err != nil {
+		return nil, err
+	}
+	state, err := r.replayed()
+	if err != nil {
+		return nil, err
+	}
+	return state.Clone(), nil
+}
+
+// Create starts a ledger for a new room with its genesis block.
+func (m *Manager) Create(roomID string, genesis block.Block) error {
+	r, err := m.room(roomID, true)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := m.open(r, roomID); err == nil {
+		return fmt.Errorf("room %s already has a ledger", roomID)
+	} else if !errors.Is(err, ErrUnknownRoom) {
+		return err
+	}
+	return m.create(r, roomID, block.Blockchain{genesis})
+}
+
+// Bootstrap starts a ledger for a room from a snapshot of its state and the
+// blocks from the checkpoint committing to it onwards, instead of from
+// genesis. The snapshot must match the checkpoint, which is blocks[0].
+func (m *Manager) Bootstrap(roomID string, state *smartcontract.State, blocks block.Blockchain) error {
+	if len(blocks) == 0 {
+		return errors.New("no blocks to bootstrap from")
+	}
+	if err := smartcontract.VerifySnapshot(state, blocks[0]); err != nil {
+		return err
+	}
+	r, err := m.room(roomID, true)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := m.open(r, roomID); err == nil {
+		return fmt.Errorf("room %s already has a ledger", roomID)
+	} else if !errors.Is(err, ErrUnknownRoom) {
+		return err
+	}
+
+	if err := m.saveSnapshot(r, roomID, state); err != nil {
+		return err
+	}
+	if err := m.create(r, roomID, blocks); err != nil {
+		os.Remove(m.snapshotPath(roomID))
+		return err
+	}
+	return nil
+}
+
+// Append adds a block to the tip of a room's chain. The block must link to
+// the current tip.
+func (m *Manager) Append(roomID string, b block.Block) error {
+	r, err := m.room(roomID, false)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := m.open(r, roomID); err != nil {
+		return err
+	}
+	if err := r.append(b); err != nil {
+		return fmt.Errorf("room %s: %v", roomID, err)
+	}
+	return nil
+}
+
+// Extend appends the block fn builds from a room's current chain and the
+// state after it, and returns the block. fn gets its own copy of the state.
+// Callers extend a room one after the other, and fn runs without blocking
+// readers; if a block from elsewhere moves the tip meanwhile, fn is called
+// again with the new chain, so a built block is never lost.
+func (m *Manager) Extend(roomID string, fn func(chain block.Blockchain, state *smartcontract.State) (block.Block, error)) (block.Block, error) {
+	r, err := m.room(roomID, false)
+	if err != nil {
+		return block.Block{}, err
+	}
+	r.build.Lock()
+	defer r.build.Unlock()
+
+	for attempt := 1; ; attempt++ {
+		r.mu.Lock()
+		var chain block.Blockchain
+		var state *smartcontract.State
+		err := m.open(r, roomID)
+		if err == nil {
+			chain = r.snapshot()
+			state, err = r.replayed()
+		}
+		if err == nil {
+			state = state.Clone()
+		}
+		r.mu.Unlock()
+		if err != nil {
+			return block.Block{}, err
+		}
+
+		b, err := fn(chain, state)
+		if err != nil {
+			return b, err
+		}
+
+		r.mu.Lock()
+		if err := m.open(r, roomID); err != nil {
+			r.mu.Unlock()
+			return b, err
+		}
+		tip := r.chain[len(r.chain)-1]
+		if tip.Hash != chain[len(chain)-1].Hash {
+			r.mu.Unlock()
+			if attempt == maxExtendAttempts {
+				return b, fmt.Errorf("room %s, block %d: %w", roomID, b.Index, ErrBusy)
+			}
+			continue
+		}
+		err = r.append(b)
+		r.mu.Unlock()
+		if err != nil {
+			err = fmt.Errorf("room %s: %v", roomID, err)
+		}
+		return b, err
+	}
+}
+
+// Update replaces a room's chain with the result of fn, which receives the
+// current chain (nil if the room is not hosted yet). Returning a nil chain
+// leaves the ledger untouched. The ledger is locked for the duration of fn.
+// Blocks shared with the current chain are kept; only the rest is rewritten.
+func (m *Manager) Update(roomID string, fn func(current block.Blockchain) (block.Blockchain, error)) error {
+	r, err := m.room(roomID, true)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	err = m.open(r, roomID)
+	if err != nil && !errors.Is(err, ErrUnknownRoom) {
+		return err
+	}
+	var current block.Blockchain
+	if err == nil {
+		current = r.snapshot()
+	}
+	next, err := fn(current)
+	if err != nil || next == nil {
+		return err
+	}
+	if current == nil {
+		return m.create(r, roomID, next)
+	}
+
+	common := 0
+	for common < len(current) && common < len(next) && current[common].Hash == next[common].Hash {
+		common++
+	}
+	if common < len(current) && common < r.floor-current[0].Index {
+		return fmt.Errorf("room %s cannot be reorganized below its snapshot at block %d", roomID, r.floor)
+	}
+	if err := r.store.Replace(common, next[common:]); err != nil {
+		return err
+	}
+	r.chain, r.state = append(block.Blockchain(nil), next...), nil
+	return nil
+}
+
+// Import loads a room's chain from a JSON ledger file, replacing any chain
+// the room has.
+func (m *Manager) Import(roomID, path string) error {
+	chain, err := block.LoadBlockchain(path)
+	if err != nil {
+		return err
+	}
+	if len(chain) == 0 {
+		return fmt.Errorf("ledger %s is empty", path)
+	}
+	return m.Update(roomID, func(block.Blockchain) (block.Blockchain, error) {
+		return chain, nil
+	})
+}
+
+// Export writes a room's chain to a JSON ledger file.
+func (m *Manager) Export(roomID, path string) error {
+	chain, err := m.Chain(roomID)
+	if err != nil {
+		return err
+	}
+	return block.SaveBlockchain(path, chain)
+}
+
+// Close closes every open store.
+func (m *Manager) Close() error {
+	if m == nil {
+		return nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var first error
+	for roomID, r := range m.rooms {
+		r.mu.Lock()
+		if r.store != nil {
+			if err := r.store.Close(); err != nil && first == nil {
+				first = err
+			}
+		}
+		r.mu.Unlock()
+		delete(m.rooms, roomID)
+	}
+	return first
+}
+
+// room returns the entry of a room. Entries for rooms without a ledger are
+// only made when the caller is about to create one.
+func (m *Manager) room(roomID string, create bool) (*roomLedger, error) {
+	if m == nil {
+		return nil, ErrNoLedgerDir
+	}
+	if err := ValidRoomID(roomID); err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if r, ok := m.rooms[roomID]; ok {
+		return r, nil
+	}
+	if !create && !m.onDisk(roomID) {
+		return nil, ErrUnknownRoom
+	}
+	r := &roomLedger{}
+	m.rooms[roomID] = r
+	return r, nil
+}
+
+// onDisk reports whether a room has a store or a legacy JSON ledger.
+func (m *Manager) onDisk(roomID string) bool {
+	for _, path := range []string{m.infoPath(roomID), m.roomDir(roomID) + ".idx", m.jsonPath(roomID)} {
+		if _, err := os.Stat(path); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// open loads a room's store and chain if they are not loaded yet, moving a
+// store into the room's directory or importing a legacy JSON ledger if the
+// room has neither. The room must be locked.
+func (m *Manager) open(r *roomLedger, roomID string) error {
+	if r.store != nil {
+		return nil
+	}
+	if err := m.migrate(roomID); err != nil {
+		return fmt.Errorf("moving ledger of room %s: %v", roomID, err)
+	}
+
+	if _, err := os.Stat(m.infoPath(roomID)); err == nil {
+		info, err := readRoomInfo(m.infoPath(roomID))
+		if err != nil {
+			return err
+		}
+		if info.Layout > RoomLayout {
+			return fmt.Errorf("room %s uses layout %d, newer than the supported %d", roomID, info.Layout, RoomLayout)
+		}
+		store, err := OpenFileStore(m.storeBase(roomID))
+		if err != nil {
+			return fmt.Errorf("ledger of room %s: %v", roomID, err)
+		}
+		chain, err := store.Blocks()
+		if err == nil && len(chain) == 0 {
+			err = fmt.Errorf("ledger of room %s is empty", roomID)
+		}
+		if err == nil {
+			if err = loadSnapshot(r, m.snapshotPath(roomID), chain); err != nil {
+				err = fmt.Errorf("snapshot of room %s: %v", roomID, err)
+			}
+		}
+		if err == nil {
+			if err = m.checkStubs(roomID, chain, store); err != nil {
+				err = fmt.Errorf("ledger of room %s: %v", roomID, err)
+			}
+		}
+		if err != nil {
+			store.Close()
+			return err
+		}
+		r.store, r.chain, r.state = store, chain, nil
+		return nil
+	}
+
+	legacy := m.jsonPath(roomID)
+	if _, err := os.Stat(legacy); err != nil {
+		return ErrUnknownRoom
+	}
+	chain, err := block.LoadBlockchain(legacy)
+	if err != nil {
+		return err
+	}
+	if len(chain) == 0 {
+		return fmt.Errorf("ledger of room %s is empty", roomID)
+	}
+	if err := m.create(r, roomID, chain); err != nil {
+		return fmt.Errorf("importing ledger of room %s: %v", roomID, err)
+	}
+	return nil
+}
+
+// create writes a chain to a new store, and then the room's metadata. A
+// store left without metadata by a crash is overwritten by the next create.
+// The room must be locked.
+func (m *Manager) create(r *roomLedger, roomID string, chain block.Blockchain) error {
+	if err := os.MkdirAll(m.roomDir(roomID), 0755); err != nil {
+		return err
+	}
+	base := m.storeBase(roomID)
+	store, err := OpenFileStore(base)
+	if err != nil {
+		return err
+	}
+	err = store.Replace(0, chain)
+	if err == nil {
+		err = writeRoomInfo(m.infoPath(roomID), RoomInfo{RoomID: roomID, Layout: RoomLayout, Created: time.Now().Unix()})
+	}
+	if err != nil {
+		store.Close()
+		for _, ext := range []string{".log", ".idx", ".wal"} {
+			os.Remove(base + ext)
+		}
+		return err
+	}
+	r.store, r.chain, r.state = store, append(block.Blockchain(nil), chain...), nil
+	return nil
+}
+
+// migrate moves a store kept directly in the manager's directory, with its
+// snapshot and archives, into the room's directory. Files are moved one by
+// one and the metadata written last, so an interrupted move is picked up
+// where it stopped.
+func (m *Manager) migrate(roomID string) error {
+	flat := m.roomDir(roomID) // Stem of the flat store files
+	if _, err := os.Stat(flat + ".idx"); err != nil {
+		return nil
+	}
+	if err := os.MkdirAll(m.roomDir(roomID), 0755); err != nil {
+		return err
+	}
+	base := m.storeBase(roomID)
+	for from, to := range map[string]string{
+		flat + ".log":     base + ".log",
+		flat + ".wal":     base + ".wal",
+		flat + ".snap":    m.snapshotPath(roomID),
+		flat + ".archive": m.archiveDir(roomID),
+	} {
+		if err := os.Rename(from, to); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	// The index goes last: it is what marks the room as not moved yet
+	if err := os.Rename(flat+".idx", base+".idx"); err != nil {
+		return err
+	}
+	if err := fsutil.SyncDir(m.dir); err != nil {
+		return err
+	}
+	return writeRoomInfo(m.infoPath(roomID), RoomInfo{RoomID: roomID, Layout: RoomLayout, Created: time.Now().Unix()})
+}
+
+func readRoomInfo(path string) (RoomInfo, error) {
+	var info RoomInfo
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return info, err
+	}
+	if err := json.Unmarshal(data, &info); err != nil {
+		return info, fmt.Errorf("%s: %v", path, err)
+	}
+	return info, nil
+}
+
+func writeRoomInfo(path string, info RoomInfo) error {
+	data, err := json.MarshalIndent(info, "", "  ")
+	if err != nil {
+		return err
+	}
+	return fsutil.WriteFileAtomic(path, data)
+}
+
+// saveSnapshot keeps the state a room's chain is replayed from, replacing
+// any earlier one, and registers it.
+func (m *Manager) saveSnapshot(r *roomLedger, roomID string, state *smartcontract.State) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(m.roomDir(roomID), 0755); err != nil {
+		return err
+	}
+	if err := fsutil.WriteFileAtomic(m.snapshotPath(roomID), data); err != nil {
+		return err
+	}
+	if err := smartcontract.AddSnapshot(state); err != nil {
+		return err
+	}
+	r.floor = state.Height
+	return nil
+}
+
+// loadSnapshot registers the snapshot a room's chain is replayed from, if
+// it was bootstrapped from one or has archived ballots. The snapshot must
+// match the checkpoint block of the chain at its height.
+func loadSnapshot(r *roomLedger, path string, chain block.Blockchain) error {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	state, err := smartcontract.DecodeState(data)
+	if err != nil {
+		return err
+	}
+	pos := state.Height - chain[0].Index
+	if pos < 0 || pos >= len(chain) {
+		return fmt.Errorf("the chain has no block %d to check the snapshot against", state.Height)
+	}
+	if err := smartcontract.VerifySnapshot(state, chain[pos]); err != nil {
+		return err
+	}
+	if err := smartcontract.AddSnapshot(state); err != nil {
+		return err
+	}
+	r.floor = state.Height
+	return nil
+}
+
+// append adds a block to the tip of the store and the cache, and advances
+// the cached state. The room must be locked and open.
+func (r *roomLedger) append(b block.Block) error {
+	tip := r.chain[len(r.chain)-1]
+	if b.PrevHash != tip.Hash || b.Index != tip.Index+1 {
+		return fmt.Errorf("block %d does not extend the tip", b.Index)
+	}
+	if err := r.store.Append(b); err != nil {
+		return err
+	}
+	r.chain = append(r.chain, b)
+	if r.state != nil {
+		r.state.Apply(b)
+	}
+	return nil
+}
+
+// replayed returns the cached state after the chain, replaying the chain
+// the first time. The state is shared with the cache and must not be
+// modified. The room must be locked and open.
+func (r *roomLedger) replayed() (*smartcontract.State, error) {
+	if r.state == nil {
+		state, err := smartcontract.Replay(r.chain)
+		if err != nil {
+			return nil, err
+		}
+		r.state = state
+	}
+	return r.state, nil
+}
+
+// snapshot returns the cached chain capped at its length, so appending to it
+// never writes into the cache. The room must be locked.
+func (r *roomLedger) snapshot() block.Blockchain {
+	return r.chain[:len(r.chain):len(r.chain)]
+}
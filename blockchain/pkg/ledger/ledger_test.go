@@ -0,0 +1,147 @@
+package ledger
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"voting-blockchain/pkg/block"
+	"voting-blockchain/pkg/smartcontract"
+)
+
+// nextBlock builds a block holding a vote that extends chain.
+func nextBlock(chain block.Blockchain, voterID string) block.Block {
+	tip := chain[len(chain)-1]
+	b := block.Block{
+		Index:     tip.Index + 1,
+		Timestamp: tip.Timestamp + 1,
+		Data:      block.VoteData{BallotID: "ballot", ChoiceID: "yes", VoterID: voterID},
+		PrevHash:  tip.Hash,
+	}
+	b.Hash = block.CalculateHash(&b)
+	return b
+}
+
+// Blocks built by Extend and blocks appended from peers race for the tip of
+// one room; every block either call reports as added must end up in the
+// chain, and the chain must link.
+func TestManagerConcurrentExtendAndAppend(t *testing.T) {
+	const extenders, peers, perWorker = 8, 4, 15
+
+	dir := t.TempDir()
+	m := NewManager(dir)
+	if err := m.Create("room", extendChain(nil, 1, "")[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	var mu sync.Mutex
+	accepted := make(map[string]bool)
+	extended := 0 // Extender blocks that were added
+	accept := func(b block.Block) {
+		mu.Lock()
+		defer mu.Unlock()
+		if accepted[b.Hash] {
+			t.Errorf("block %d was added twice", b.Index)
+		}
+		accepted[b.Hash] = true
+	}
+
+	var wg sync.WaitGroup
+	for w := 0; w < extenders; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < perWorker; i++ {
+				voter := fmt.Sprintf("extender-%d-%d", w, i)
+				b, err := m.Extend("room", func(chain block.Blockchain, state *smartcontract.State) (block.Block, error) {
+					b := nextBlock(chain, voter)
+					if err := state.Validate(b.Data, b.Timestamp); err != nil {
+						return block.Block{}, err
+					}
+					return b, nil
+				})
+				if errors.Is(err, ErrBusy) {
+					continue // Lost the tip too often; the block was not added
+				}
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				accept(b)
+				mu.Lock()
+				extended++
+				mu.Unlock()
+			}
+		}(w)
+	}
+	for p := 0; p < peers; p++ {
+		wg.Add(1)
+		go func(p int) {
+			defer wg.Done()
+			for i := 0; i < perWorker; i++ {
+				voter := fmt.Sprintf("peer-%d-%d", p, i)
+				// Peers retry until their block lands on the current tip
+				for {
+					chain, err := m.Chain("room")
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					b := nextBlock(chain, voter)
+					if err := m.Append("room", b); err == nil {
+						accept(b)
+						break
+					}
+				}
+			}
+		}(p)
+	}
+	wg.Wait()
+
+	check := func(m *Manager) {
+		t.Helper()
+		chain, err := m.Chain("room")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(chain) != len(accepted)+1 {
+			t.Fatalf("chain holds %d blocks after genesis, %d were added", len(chain)-1, len(accepted))
+		}
+		for i := 1; i < len(chain); i++ {
+			if chain[i].PrevHash != chain[i-1].Hash || chain[i].Index != chain[i-1].Index+1 {
+				t.Fatalf("block %d does not link to its predecessor", chain[i].Index)
+			}
+			if !accepted[chain[i].Hash] {
+				t.Fatalf("block %d was never reported as added", chain[i].Index)
+			}
+		}
+		// The cached state must match a replay of the chain
+		state, err := m.State("room")
+		if err != nil {
+			t.Fatal(err)
+		}
+		replayed, err := smartcontract.Replay(chain)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(state, replayed) {
+			t.Fatal("cached state differs from the replayed chain")
+		}
+	}
+	check(m)
+	if extended == 0 {
+		t.Fatal("no extender block was added")
+	}
+	if len(accepted) != peers*perWorker+extended {
+		t.Fatalf("%d blocks were added, want %d from peers and %d from extenders", len(accepted), peers*perWorker, extended)
+	}
+
+	// And it must all be on disk
+	if err := m.Close(); err != nil {
+		t.Fatal(err)
+	}
+	m = NewManager(dir)
+	defer m.Close()
+	check(m)
+}
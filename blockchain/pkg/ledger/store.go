@@ -0,0 +1,544 @@
+package ledger
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"voting-blockchain/pkg/block"
+	"voting-blockchain/pkg/fsutil"
+)
+
+// ErrNotFound is returned for blocks a store does not hold.
+var ErrNotFound = errors.New("block not found")
+
+// LedgerStore persists the chain of one room.
+type LedgerStore interface {
+	// Len returns the number of blocks in the store.
+	Len() int
+	// Tip returns the last block.
+	Tip() (block.Block, error)
+	// BlockAt returns the block at a height.
+	BlockAt(height int) (block.Block, error)
+	// BlockByHash returns the block with a hash.
+	BlockByHash(hash string) (block.Block, error)
+	// Blocks returns the whole chain.
+	Blocks() (block.Blockchain, error)
+	// Append adds a block that extends the tip, or a genesis block to an
+	// empty store.
+	Append(b block.Block) error
+	// Replace atomically drops every block from height on and appends
+	// blocks in their place.
+	Replace(height int, blocks []block.Block) error
+	// Truncate drops every block from height n on.
+	Truncate(n int) error
+	// BlocksByBallot returns the records of the ballots in chain order; the
+	// empty ballot ID selects the room-wide records.
+	BlocksByBallot(ballotIDs ...string) (block.Blockchain, error)
+	// VotesBy returns a named voter's vote and revote blocks on a ballot in
+	// chain order.
+	VotesBy(ballotID, voterID string) (block.Blockchain, error)
+	// HasVoted reports whether a named voter has voted on a ballot, that is
+	// whether the ballot has used the voter's nullifier.
+	HasVoted(ballotID, voterID string) bool
+	// BlocksBetween returns the blocks timestamped from from to to,
+	// inclusive, in timestamp order.
+	BlocksBetween(from, to int64) (block.Blockchain, error)
+	// Close releases the store's files.
+	Close() error
+}
+
+// FileStore is an append-only LedgerStore on disk. Blocks are appended as
+// JSON lines to a log file, and a fixed-width index file maps each height to
+// the block's position in the log and its hash, so appends and lookups by
+// height or hash never read the rest of the chain. Secondary indexes by
+// ballot, voter and timestamp are kept in memory for the same reason.
+//
+// Every change goes through a write-ahead log: the change is written to the
+// WAL and synced before the log and index are touched, and the WAL is only
+// cleared once they are synced too. After a crash, opening the store replays
+// a complete WAL record and discards a partial one, so the store always
+// comes back with the chain from before or after the interrupted change.
+type FileStore struct {
+	mu      sync.Mutex
+	log     *os.File
+	idx     *os.File
+	wal     *os.File
+	entries []indexEntry
+	heights map[string]int // Height of each block by hash
+	index   storeIndex     // Secondary indexes by ballot, voter and time
+	tip     block.Block    // Last block, valid when entries is not empty
+	failed  error          // Set when a change was left half applied
+}
+
+// indexEntry locates one block in the log.
+type indexEntry struct {
+	offset int64
+	length uint32
+	hash   string
+}
+
+// walRecord describes one change: truncate the chain to Height, then append
+// Blocks. Replaying a record is idempotent.
+type walRecord struct {
+	Height int           `json:"height"`
+	Blocks []block.Block `json:"blocks"`
+}
+
+// Index entries are an 8-byte offset, a 4-byte length and the 64 hex
+// characters of the block hash. WAL records are a 4-byte length and a
+// 4-byte CRC-32 of the JSON record that follows.
+const (
+	hashLength       = 64
+	indexEntryLength = 8 + 4 + hashLength
+	walHeaderLength  = 4 + 4
+)
+
+var _ LedgerStore = (*FileStore)(nil)
+
+// crashHook, if set, is called after each step of committing a change.
+// Tests return an error from it to simulate a crash after that step.
+var crashHook func(step string) error
+
+func afterStep(step string) error {
+	if crashHook == nil {
+		return nil
+	}
+	return crashHook(step)
+}
+
+// OpenFileStore opens the store kept in the files base.log, base.idx and
+// base.wal, creating them if needed, and recovers from any interrupted
+// change. Every block is checked against its hash and its predecessor, so a
+// tampered ledger fails to open.
+func OpenFileStore(base string) (*FileStore, error) {
+	s := &FileStore{heights: make(map[string]int), index: newStoreIndex()}
+	for _, f := range []struct {
+		file **os.File
+		path string
+	}{{&s.log, base + ".log"}, {&s.idx, base + ".idx"}, {&s.wal, base + ".wal"}} {
+		file, err := os.OpenFile(f.path, os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		*f.file = file
+	}
+	if err := fsutil.SyncDir(filepath.Dir(base)); err != nil {
+		s.Close()
+		return nil, err
+	}
+	if err := s.recover(); err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// recover loads the store, replaying the pending WAL record if there is one.
+func (s *FileStore) recover() error {
+	pending, err := s.readWAL()
+	if err != nil {
+		return err
+	}
+	if pending == nil {
+		if err := s.load(-1); err != nil {
+			return err
+		}
+		return s.clearWAL() // Drop a record that was never fully written
+	}
+
+	// Blocks from the record's height on may have been half written, so
+	// only the ones below it are trusted before replaying the change
+	if err := s.load(pending.Height); err != nil {
+		return err
+	}
+	if len(s.entries) < pending.Height {
+		return fmt.Errorf("write-ahead log starts at height %d but the ledger has %d blocks", pending.Height, len(s.entries))
+	}
+	if err := s.apply(pending); err != nil {
+		return err
+	}
+	return s.clearWAL()
+}
+
+// readWAL returns the complete record in the WAL, or nil if the WAL is empty
+// or holds a record that was never fully written.
+func (s *FileStore) readWAL() (*walRecord, error) {
+	raw, err := readAll(s.wal)
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) < walHeaderLength {
+		return nil, nil
+	}
+	length := binary.BigEndian.Uint32(raw[0:4])
+	sum := binary.BigEndian.Uint32(raw[4:8])
+	if uint64(len(raw)-walHeaderLength) < uint64(length) {
+		return nil, nil // Torn write
+	}
+	payload := raw[walHeaderLength : walHeaderLength+int(length)]
+	if crc32.ChecksumIEEE(payload) != sum {
+		return nil, nil
+	}
+	var rec walRecord
+	if err := json.Unmarshal(payload, &rec); err != nil {
+		return nil, fmt.Errorf("write-ahead log: %v", err)
+	}
+	return &rec, nil
+}
+
+// load reads the first limit index entries, or all of them if limit is
+// negative, and verifies the chain they point to.
+func (s *FileStore) load(limit int) error {
+	raw, err := readAll(s.idx)
+	if err != nil {
+		return err
+	}
+	count := len(raw) / indexEntryLength
+	if limit < 0 {
+		if len(raw)%indexEntryLength != 0 {
+			return fmt.Errorf("index has a partial entry")
+		}
+	} else if count > limit {
+		count = limit
+	}
+
+	s.entries = nil
+	s.heights = make(map[string]int)
+	s.index = newStoreIndex()
+	var prev *block.Block
+	for i := 0; i < count; i++ {
+		entry := decodeEntry(raw[i*indexEntryLength : (i+1)*indexEntryLength])
+		b, err := s.read(entry)
+		if err != nil {
+			return fmt.Errorf("block %d: %v", i, err)
+		}
+		if err := checkLink(prev, &b); err != nil {
+			return err
+		}
+		if b.Hash != entry.hash {
+			return fmt.Errorf("index does not match block %d", b.Index)
+		}
+		s.heights[entry.hash] = i
+		s.index.add(i, &b)
+		s.entries = append(s.entries, entry)
+		s.tip = b
+		prev = &s.tip
+	}
+	return nil
+}
+
+func (s *FileStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.entries)
+}
+
+func (s *FileStore) Tip() (block.Block, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.entries) == 0 {
+		return block.Block{}, ErrNotFound
+	}
+	return s.tip, nil
+}
+
+func (s *FileStore) BlockAt(height int) (block.Block, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if height < 0 || height >= len(s.entries) {
+		return block.Block{}, ErrNotFound
+	}
+	return s.read(s.entries[height])
+}
+
+func (s *FileStore) BlockByHash(hash string) (block.Block, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	height, ok := s.heights[hash]
+	if !ok {
+		return block.Block{}, ErrNotFound
+	}
+	return s.read(s.entries[height])
+}
+
+func (s *FileStore) Blocks() (block.Blockchain, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.entries) == 0 {
+		return block.Blockchain{}, nil
+	}
+	raw := make([]byte, s.end())
+	if _, err := s.log.ReadAt(raw, 0); err != nil {
+		return nil, err
+	}
+	chain := make(block.Blockchain, len(s.entries))
+	for i, entry := range s.entries {
+		if err := json.Unmarshal(raw[entry.offset:entry.offset+int64(entry.length)], &chain[i]); err != nil {
+			return nil, fmt.Errorf("block %d: %v", i, err)
+		}
+	}
+	return chain, nil
+}
+
+func (s *FileStore) Append(b block.Block) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.commit(&walRecord{Height: len(s.entries), Blocks: []block.Block{b}})
+}
+
+func (s *FileStore) Replace(height int, blocks []block.Block) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.commit(&walRecord{Height: height, Blocks: blocks})
+}
+
+func (s *FileStore) Truncate(n int) error {
+	return s.Replace(n, nil)
+}
+
+func (s *FileStore) Close() error {
+	var first error
+	for _, f := range []*os.File{s.log, s.idx, s.wal} {
+		if f == nil {
+			continue
+		}
+		if err := f.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// commit validates a change, records it in the WAL and applies it.
+func (s *FileStore) commit(rec *walRecord) error {
+	if s.failed != nil {
+		return fmt.Errorf("ledger must be reopened to recover from: %v", s.failed)
+	}
+	if rec.Height < 0 || rec.Height > len(s.entries) {
+		return fmt.Errorf("cannot replace blocks from height %d of %d", rec.Height, len(s.entries))
+	}
+	if rec.Height == len(s.entries) && len(rec.Blocks) == 0 {
+		return nil
+	}
+	var prev *block.Block
+	if rec.Height > 0 {
+		b, err := s.read(s.entries[rec.Height-1])
+		if err != nil {
+			return err
+		}
+		prev = &b
+	}
+	for i := range rec.Blocks {
+		b := &rec.Blocks[i]
+		if err := checkLink(prev, b); err != nil {
+			return err
+		}
+		if len(b.Hash) != hashLength {
+			return fmt.Errorf("block %d has a malformed hash", b.Index)
+		}
+		if b.Archived {
+			if err := s.checkStub(rec.Height+i, b); err != nil {
+				return err
+			}
+		}
+		prev = b
+	}
+
+	if err := s.writeWAL(rec); err != nil {
+		return err
+	}
+	err := afterStep("wal")
+	if err == nil {
+		err = s.apply(rec)
+	}
+	if err != nil {
+		// The WAL still holds the change; reopening the store replays it
+		s.failed = err
+		return err
+	}
+	return s.clearWAL()
+}
+
+// apply truncates the log and index to the record's height, appends its
+// blocks and syncs both files.
+func (s *FileStore) apply(rec *walRecord) error {
+	offset := s.end()
+	if rec.Height < len(s.entries) {
+		offset = s.entries[rec.Height].offset
+	}
+	if rec.Height < len(s.entries) {
+		s.index.truncate(rec.Height)
+	}
+	for _, entry := range s.entries[rec.Height:] {
+		delete(s.heights, entry.hash)
+	}
+	s.entries = s.entries[:rec.Height]
+
+	var data, index []byte
+	for i := range rec.Blocks {
+		b := &rec.Blocks[i]
+		raw, err := json.Marshal(b)
+		if err != nil {
+			return err
+		}
+		entry := indexEntry{offset: offset + int64(len(data)), length: uint32(len(raw)), hash: b.Hash}
+		data = append(append(data, raw...), '\n')
+		index = append(index, encodeEntry(entry)...)
+		s.heights[b.Hash] = len(s.entries)
+		s.index.add(len(s.entries), b)
+		s.entries = append(s.entries, entry)
+	}
+
+	if err := s.log.Truncate(offset); err != nil {
+		return err
+	}
+	if _, err := s.log.WriteAt(data, offset); err != nil {
+		return err
+	}
+	if err := afterStep("log"); err != nil {
+		return err
+	}
+	if err := s.idx.Truncate(int64(rec.Height) * indexEntryLength); err != nil {
+		return err
+	}
+	if _, err := s.idx.WriteAt(index, int64(rec.Height)*indexEntryLength); err != nil {
+		return err
+	}
+	if err := s.log.Sync(); err != nil {
+		return err
+	}
+	if err := s.idx.Sync(); err != nil {
+		return err
+	}
+	if err := afterStep("index"); err != nil {
+		return err
+	}
+
+	switch {
+	case len(rec.Blocks) > 0:
+		s.tip = rec.Blocks[len(rec.Blocks)-1]
+	case len(s.entries) > 0:
+		tip, err := s.read(s.entries[len(s.entries)-1])
+		if err != nil {
+			return err
+		}
+		s.tip = tip
+	}
+	return nil
+}
+
+func (s *FileStore) writeWAL(rec *walRecord) error {
+	payload, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	header := make([]byte, walHeaderLength)
+	binary.BigEndian.PutUint32(header[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(header[4:8], crc32.ChecksumIEEE(payload))
+	if err := s.wal.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := s.wal.WriteAt(append(header, payload...), 0); err != nil {
+		return err
+	}
+	return s.wal.Sync()
+}
+
+func (s *FileStore) clearWAL() error {
+	if err := s.wal.Truncate(0); err != nil {
+		return err
+	}
+	return s.wal.Sync()
+}
+
+// checkStub verifies that an archived stub replaces the block it stands for
+// at its height, keeping every field of that block but the dropped data.
+func (s *FileStore) checkStub(height int, stub *block.Block) error {
+	if height >= len(s.entries) {
+		return fmt.Errorf("block %d cannot be added as an archived stub", stub.Index)
+	}
+	b, err := s.read(s.entries[height])
+	if err != nil {
+		return err
+	}
+	if b.Stub() != *stub {
+		return fmt.Errorf("stub of block %d does not match the block", stub.Index)
+	}
+	return nil
+}
+
+// end returns the log offset the next block is written at.
+func (s *FileStore) end() int64 {
+	if len(s.entries) == 0 {
+		return 0
+	}
+	last := s.entries[len(s.entries)-1]
+	return last.offset + int64(last.length) + 1 // Newline after each block
+}
+
+func (s *FileStore) read(entry indexEntry) (block.Block, error) {
+	raw := make([]byte, entry.length)
+	if _, err := s.log.ReadAt(raw, entry.offset); err != nil {
+		return block.Block{}, err
+	}
+	var b block.Block
+	if err := json.Unmarshal(raw, &b); err != nil {
+		return block.Block{}, err
+	}
+	return b, nil
+}
+
+// checkLink verifies that b is a valid block following prev, which is nil
+// for the first block of the store. The first block is the genesis block
+// unless the room was bootstrapped from a snapshot, in which case the store
+// starts at a checkpoint and heights are counted from there. Archived blocks
+// are only checked for their link here: commit only accepts a stub in place
+// of its own block, and the Manager checks the stubs of a room against its
+// archives when it opens the room.
+func checkLink(prev, b *block.Block) error {
+	if prev != nil && (b.PrevHash != prev.Hash || b.Index != prev.Index+1) {
+		return fmt.Errorf("block %d does not extend block %d", b.Index, prev.Index)
+	}
+	if b.Archived {
+		return nil // Held in place by the next block's link
+	}
+	if b.Hash != block.CalculateHash(b) {
+		return fmt.Errorf("block %d has been tampered with", b.Index)
+	}
+	return nil
+}
+
+func encodeEntry(entry indexEntry) []byte {
+	raw := make([]byte, indexEntryLength)
+	binary.BigEndian.PutUint64(raw[0:8], uint64(entry.offset))
+	binary.BigEndian.PutUint32(raw[8:12], entry.length)
+	copy(raw[12:], entry.hash)
+	return raw
+}
+
+func decodeEntry(raw []byte) indexEntry {
+	return indexEntry{
+		offset: int64(binary.BigEndian.Uint64(raw[0:8])),
+		length: binary.BigEndian.Uint32(raw[8:12]),
+		hash:   string(raw[12:]),
+	}
+}
+
+func readAll(f *os.File) ([]byte, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	raw := make([]byte, info.Size())
+	if _, err := f.ReadAt(raw, 0); err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	return raw, nil
+}
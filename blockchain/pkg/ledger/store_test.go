@@ -0,0 +1,180 @@
+package ledger
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"voting-blockchain/pkg/block"
+)
+
+var errCrash = errors.New("simulated crash")
+
+// extendChain returns a copy of chain with n more blocks, starting a new
+// chain at genesis if chain is empty. Forks of a chain are made by
+// extending the same prefix with a different ballot ID.
+func extendChain(chain block.Blockchain, n int, ballotID string) block.Blockchain {
+	chain = append(block.Blockchain{}, chain...)
+	for i := 0; i < n; i++ {
+		b := block.Block{Index: 0, Timestamp: 1000, Data: block.VoteData{BallotID: "genesis", ChoiceID: "genesis"}, PrevHash: "0"}
+		if len(chain) > 0 {
+			tip := chain[len(chain)-1]
+			b = block.Block{
+				Index:     tip.Index + 1,
+				Timestamp: tip.Timestamp + 1,
+				Data:      block.VoteData{BallotID: ballotID, ChoiceID: fmt.Sprint("choice-", tip.Index+1)},
+				PrevHash:  tip.Hash,
+			}
+		}
+		b.Hash = block.CalculateHash(&b)
+		chain = append(chain, b)
+	}
+	return chain
+}
+
+func hashes(chain block.Blockchain) []string {
+	out := make([]string, len(chain))
+	for i, b := range chain {
+		out[i] = b.Hash
+	}
+	return out
+}
+
+// crashDuring opens a store holding before, commits the change from height
+// on, crashing after step, and returns the chain the reopened store holds.
+// mangle, if set, damages the store's files at the crash.
+func crashDuring(t *testing.T, before block.Blockchain, height int, blocks block.Blockchain, step string, mangle func(base string)) block.Blockchain {
+	t.Helper()
+	base := filepath.Join(t.TempDir(), "ledger")
+	s, err := OpenFileStore(base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Replace(0, before); err != nil {
+		t.Fatal(err)
+	}
+
+	crashHook = func(at string) error {
+		if at != step {
+			return nil
+		}
+		if mangle != nil {
+			mangle(base)
+		}
+		return errCrash
+	}
+	err = s.Replace(height, blocks)
+	crashHook = nil
+	if !errors.Is(err, errCrash) {
+		t.Fatalf("commit did not crash after %s: %v", step, err)
+	}
+	if err := s.Truncate(0); err == nil {
+		t.Fatal("store accepted a change after a crash")
+	}
+	s.Close()
+
+	s, err = OpenFileStore(base)
+	if err != nil {
+		t.Fatalf("reopening after a crash after %s: %v", step, err)
+	}
+	defer s.Close()
+	chain, err := s.Blocks()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The reopened store must take further changes
+	next := extendChain(chain, 1, "next")
+	if err := s.Append(next[len(next)-1]); err != nil {
+		t.Fatalf("appending after recovery: %v", err)
+	}
+	return chain
+}
+
+func truncateFile(t *testing.T, path string, size int64) {
+	t.Helper()
+	if err := os.Truncate(path, size); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func fileSize(t *testing.T, path string) int64 {
+	t.Helper()
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info.Size()
+}
+
+// Every change is either fully applied or not at all, wherever it is cut.
+func TestFileStoreCrashRecovery(t *testing.T) {
+	main := extendChain(nil, 6, "a")
+	fork := extendChain(main[:3], 5, "b")
+
+	changes := []struct {
+		name   string
+		before block.Blockchain
+		height int
+		after  block.Blockchain
+	}{
+		{"append", main[:5], 5, main},
+		{"genesis", nil, 0, main[:1]},
+		{"reorganize", main, 3, fork},
+		{"truncate and extend", fork, 5, extendChain(fork[:5], 1, "c")},
+		{"truncate", fork, 4, fork[:4]},
+	}
+
+	for _, c := range changes {
+		blocks := c.after[c.height:]
+		before, after := hashes(c.before), hashes(c.after)
+		check := func(t *testing.T, got block.Blockchain, want []string) {
+			t.Helper()
+			if fmt.Sprint(hashes(got)) != fmt.Sprint(want) {
+				t.Fatalf("reopened store holds %v, want %v", hashes(got), want)
+			}
+		}
+
+		t.Run(c.name, func(t *testing.T) {
+			// A WAL record cut anywhere is discarded
+			t.Run("torn wal", func(t *testing.T) {
+				for _, keep := range []int64{0, 1, walHeaderLength - 1, walHeaderLength, walHeaderLength + 10, -1} {
+					got := crashDuring(t, c.before, c.height, blocks, "wal", func(base string) {
+						size := keep
+						if size < 0 {
+							size = fileSize(t, base+".wal") - 1
+						}
+						truncateFile(t, base+".wal", size)
+					})
+					check(t, got, before)
+				}
+			})
+
+			// A complete WAL record is replayed however far the change got
+			for _, step := range []string{"wal", "log", "index"} {
+				t.Run("after "+step, func(t *testing.T) {
+					check(t, crashDuring(t, c.before, c.height, blocks, step, nil), after)
+				})
+			}
+
+			if len(blocks) == 0 {
+				return
+			}
+			// Blocks half written to the log are rewritten from the WAL
+			t.Run("torn log", func(t *testing.T) {
+				got := crashDuring(t, c.before, c.height, blocks, "log", func(base string) {
+					truncateFile(t, base+".log", fileSize(t, base+".log")-5)
+				})
+				check(t, got, after)
+			})
+
+			// So are index entries
+			t.Run("torn index", func(t *testing.T) {
+				got := crashDuring(t, c.before, c.height, blocks, "index", func(base string) {
+					truncateFile(t, base+".idx", fileSize(t, base+".idx")-indexEntryLength/2)
+				})
+				check(t, got, after)
+			})
+		})
+	}
+}
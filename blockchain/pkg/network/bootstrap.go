@@ -0,0 +1,125 @@
+package network
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"time"
+	"voting-blockchain/pkg/fsutil"
+)
+
+// maxAddrs bounds the addresses exchanged in one addr message.
+const maxAddrs = 1000
+
+// Bootstrap connects to the configured peers. Static peers are kept
+// connected for the lifetime of the node; seeds are only asked for the
+// addresses they know (getaddr) so the node can find the rest of the network.
+func (n *Node) Bootstrap(static, seeds []string) {
+	for _, addr := range static {
+		n.Peers.AddStatic(addr)
+		go n.connect(addr, false)
+	}
+	for _, addr := range seeds {
+		n.Peers.Add(addr)
+		go n.connect(addr, true)
+	}
+}
+
+func (n *Node) connect(addr string, askAddrs bool) {
+	p, err := n.dialPeer(addr)
+	if err != nil {
+		log.Printf("Error connecting to %s: %v\n", addr, err)
+		return
+	}
+	if askAddrs {
+		if err := p.Send("getaddr", nil); err != nil {
+			log.Printf("Error requesting addresses from %s: %v\n", addr, err)
+		}
+	}
+}
+
+// addrList returns our address followed by up to maxAddrs-1 known peers.
+func (n *Node) addrList() Addr {
+	addrs := n.Peers.Addrs()
+	if len(addrs) > maxAddrs-1 {
+		n.shuffle(addrs)
+		addrs = addrs[:maxAddrs-1]
+	}
+	return Addr{AddrList: append([]string{n.LocalAddr}, addrs...)}
+}
+
+// handleGetAddr answers with our address followed by the peers we know.
+func (n *Node) handleGetAddr(p *Peer) {
+	nodes := n.addrList()
+	if err := p.Send("addr", GobEncode(nodes)); err != nil {
+		log.Printf("Error sending addresses to %s: %v\n", p.Addr, err)
+	}
+}
+
+// addressBookEntry is the persisted form of a known peer.
+type addressBookEntry struct {
+	Addr     string    `json:"addr"`
+	NodeID   string    `json:"nodeId,omitempty"`
+	LastSeen time.Time `json:"lastSeen"`
+	Static   bool      `json:"static,omitempty"`
+}
+
+// LoadAddressBook adds the peers saved in an address book file. Peers saved
+// as static stay static, so they are redialed like configured ones. A
+// missing file is not an error.
+func (n *Node) LoadAddressBook(path string) error {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var entries []addressBookEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if !n.Peers.Add(entry.Addr) {
+			continue
+		}
+		if entry.Static {
+			n.Peers.AddStatic(entry.Addr)
+		}
+		n.Peers.update(entry.Addr, func(rec *PeerRecord) {
+			rec.NodeID = entry.NodeID
+			rec.LastSeen = entry.LastSeen
+		})
+	}
+	return nil
+}
+
+// SaveAddressBook writes the known peers to path, replacing it atomically.
+func (n *Node) SaveAddressBook(path string) error {
+	var entries []addressBookEntry
+	for _, rec := range n.Peers.Records() {
+		if rec.State == StateBanned {
+			continue
+		}
+		entries = append(entries, addressBookEntry{Addr: rec.Addr, NodeID: rec.NodeID, LastSeen: rec.LastSeen, Static: rec.Static})
+	}
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	return fsutil.WriteFileAtomic(path, data)
+}
+
+// PersistAddressBook saves the address book every interval.
+func (n *Node) PersistAddressBook(path string, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if err := n.SaveAddressBook(path); err != nil {
+				log.Printf("Error saving address book: %v\n", err)
+			}
+		}
+	}()
+}
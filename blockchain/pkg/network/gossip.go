@@ -0,0 +1,251 @@
+package network
+
+import (
+	"log"
+	"sync"
+	"time"
+	"voting-blockchain/pkg/block"
+)
+
+// Inventory gossip. New blocks and transactions are announced by hash in
+// inv messages to a limited number of subscribers; a peer that has not seen
+// an item fetches it with getdata and relays its own announcement once the
+// item has been accepted. Items are marked seen when they arrive, which keeps
+// them from circulating forever; while a request is outstanding the item is
+// only marked in flight, so announcements from other peers are fetched once
+// the request expires unanswered.
+const (
+	InvBlock = "block"
+	InvTx    = "tx"
+
+	seenTTL     = 10 * time.Minute
+	inFlightTTL = 30 * time.Second
+	maxSeen     = 100000
+	maxMempool  = 10000
+	maxInvItems = 1000
+)
+
+// DefaultMaxFanout bounds how many peers an item is announced to, unless
+// the node sets its own MaxFanout.
+const DefaultMaxFanout = 8
+
+// InvItem identifies a block or transaction by hash.
+type InvItem struct {
+	Type string
+	Hash string
+}
+
+type invMsg struct {
+	RoomID string
+	Items  []InvItem
+}
+
+// TxMsg carries a transaction that has not been mined yet.
+type TxMsg struct {
+	RoomID string
+	Data   block.VoteData
+}
+
+// seenCache remembers item hashes for a limited time.
+type seenCache struct {
+	mu    sync.Mutex
+	ttl   time.Duration
+	now   func() time.Time
+	items map[string]time.Time
+}
+
+func newSeenCache(ttl time.Duration, now func() time.Time) *seenCache {
+	return &seenCache{ttl: ttl, now: now, items: make(map[string]time.Time)}
+}
+
+// Add records a hash and reports whether it was new.
+func (c *seenCache) Add(hash string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.now()
+	if seenAt, ok := c.items[hash]; ok && now.Sub(seenAt) < c.ttl {
+		return false
+	}
+	if len(c.items) >= maxSeen {
+		for h, seenAt := range c.items {
+			if now.Sub(seenAt) >= c.ttl || len(c.items) >= maxSeen {
+				delete(c.items, h)
+			}
+		}
+	}
+	c.items[hash] = now
+	return true
+}
+
+// Has reports whether a hash was recorded and has not expired.
+func (c *seenCache) Has(hash string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	seenAt, ok := c.items[hash]
+	return ok && c.now().Sub(seenAt) < c.ttl
+}
+
+// AnnounceBlock gossips a block that was just added to a room's chain.
+func (n *Node) AnnounceBlock(roomID string, b *block.Block) {
+	n.seenBlocks.Add(b.Hash)
+	n.announce(roomID, InvItem{Type: InvBlock, Hash: b.Hash}, "")
+}
+
+// AnnounceTx gossips a transaction that has been validated but not mined
+// yet, so peers learn of it while its block is being mined. The transaction
+// is dropped from the mempool once its block is added.
+func (n *Node) AnnounceTx(roomID string, data block.VoteData) {
+	hash := block.HashData(data)
+	if !n.seenTxs.Add(hash) {
+		return // Already announced
+	}
+	n.addToMempool(hash, TxMsg{RoomID: roomID, Data: data})
+	n.announce(roomID, InvItem{Type: InvTx, Hash: hash}, "")
+}
+
+// announce sends an inv for one item to a random subset of the room's
+// subscribers, skipping the peer it came from. Peers without the gossip
+// capability are sent new blocks directly instead.
+func (n *Node) announce(roomID string, item InvItem, except string) {
+	peers := n.Subscribers(roomID)
+	n.shuffle(peers)
+
+	payload := GobEncode(invMsg{RoomID: roomID, Items: []InvItem{item}})
+	sent := 0
+	for _, peer := range peers {
+		if sent >= n.MaxFanout {
+			break
+		}
+		if peer == except {
+			continue
+		}
+		if !n.supports(peer, CapGossip) {
+			if item.Type == InvBlock {
+				n.sendBlockByHash(peer, roomID, item.Hash)
+			}
+			continue
+		}
+		n.sendData(peer, "inv", payload)
+		sent++
+	}
+}
+
+// sendBlockByHash pushes a block from our chain to a peer.
+func (n *Node) sendBlockByHash(addr, roomID, hash string) {
+	if b, ok := n.sendableBlock(roomID, hash); ok {
+		n.SendBlock(addr, roomID, &b)
+	}
+}
+
+func (n *Node) addToMempool(hash string, tx TxMsg) {
+	n.mempoolMu.Lock()
+	defer n.mempoolMu.Unlock()
+	if len(n.mempool) >= maxMempool {
+		for h := range n.mempool {
+			delete(n.mempool, h)
+			break
+		}
+	}
+	n.mempool[hash] = tx
+}
+
+// RemoveFromMempool drops transactions once they have been mined.
+func (n *Node) RemoveFromMempool(data block.VoteData) {
+	n.mempoolMu.Lock()
+	defer n.mempoolMu.Unlock()
+	delete(n.mempool, block.HashData(data))
+}
+
+// handleInv requests the announced items we have not seen yet.
+func (n *Node) handleInv(p *Peer, payload []byte) {
+	var msg invMsg
+	if !decode(p, payload, &msg, "inv") {
+		return
+	}
+	if !n.Ledgers.Hosts(msg.RoomID) || len(msg.Items) > maxInvItems {
+		return
+	}
+
+	want := invMsg{RoomID: msg.RoomID}
+	for _, item := range msg.Items {
+		var seen, inFlight *seenCache
+		switch item.Type {
+		case InvBlock:
+			seen, inFlight = n.seenBlocks, n.inFlightBlocks
+		case InvTx:
+			seen, inFlight = n.seenTxs, n.inFlightTxs
+		default:
+			continue
+		}
+		if !seen.Has(item.Hash) && inFlight.Add(item.Hash) {
+			want.Items = append(want.Items, item)
+		}
+	}
+	if len(want.Items) == 0 {
+		return
+	}
+	if err := p.Send("getdata", GobEncode(want)); err != nil {
+		log.Printf("Error requesting data from %s: %v\n", p.Addr, err)
+	}
+}
+
+// handleGetData sends the requested blocks and transactions that we have.
+func (n *Node) handleGetData(p *Peer, payload []byte) {
+	var msg invMsg
+	if !decode(p, payload, &msg, "getdata") {
+		return
+	}
+	if len(msg.Items) > maxInvItems {
+		return
+	}
+
+	for _, item := range msg.Items {
+		var err error
+		switch item.Type {
+		case InvBlock:
+			if b, ok := n.sendableBlock(msg.RoomID, item.Hash); ok {
+				err = p.Send("block", GobEncode(BlockMsg{RoomID: msg.RoomID, Block: b}))
+			}
+		case InvTx:
+			n.mempoolMu.Lock()
+			tx, ok := n.mempool[item.Hash]
+			n.mempoolMu.Unlock()
+			if ok && tx.RoomID == msg.RoomID {
+				err = p.Send("tx", GobEncode(tx))
+			}
+		}
+		if err != nil {
+			log.Printf("Error sending data to %s: %v\n", p.Addr, err)
+			return
+		}
+	}
+}
+
+// handleTx accepts a relayed transaction and passes it on if it is valid
+// against the room's current state. A transaction that is not may only be
+// stale here, so it is dropped without penalizing the peer.
+func (n *Node) handleTx(p *Peer, payload []byte) {
+	var tx TxMsg
+	if !decode(p, payload, &tx, "tx") {
+		return
+	}
+	if !n.Ledgers.Hosts(tx.RoomID) {
+		return
+	}
+
+	hash := block.HashData(tx.Data)
+	if !n.seenTxs.Add(hash) {
+		return
+	}
+	state, err := n.Ledgers.State(tx.RoomID)
+	if err != nil {
+		log.Printf("Error loading room %s: %v\n", tx.RoomID, err)
+		return
+	}
+	if err := state.Validate(tx.Data, n.now().Unix()); err != nil {
+		return
+	}
+	n.addToMempool(hash, tx)
+	n.announce(tx.RoomID, InvItem{Type: InvTx, Hash: hash}, p.ListenAddr())
+}
@@ -0,0 +1,235 @@
+package network
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"time"
+	"voting-blockchain/pkg/consensus"
+)
+
+// Handshake. The dialing node opens every connection with a version message
+// and the listening node answers with its own; each side acknowledges an
+// acceptable version with verack. No other message is processed before the
+// peer's version has been accepted.
+const (
+	ProtocolVersion    uint32 = 2 // Version spoken by this node
+	MinProtocolVersion uint32 = 2 // Oldest version this node still accepts
+
+	CapSync     = "sync"     // Serves getheaders/getblocks
+	CapGossip   = "gossip"   // Understands inv/getdata
+	CapSnapshot = "snapshot" // Serves getsnapshot
+
+	// Time a new connection has to complete the TLS handshake and send its
+	// version before it is closed
+	handshakeTimeout = 10 * time.Second
+)
+
+// Capabilities advertised by this node.
+var Capabilities = []string{CapSync, CapGossip, CapSnapshot}
+
+type versionMsg struct {
+	Version      uint32
+	NodeID       string
+	Addr         string         // Listening address of the sender
+	Consensus    string         // Consensus engine the sender validates blocks with
+	Rooms        map[string]int // Hosted rooms and their best heights
+	Capabilities []string
+}
+
+// PeerInfo is what a peer told us about itself in its handshake. Peers are
+// known by the node ID they authenticated with; the address a peer
+// advertises is only recorded once dialing it reached the same node.
+type PeerInfo struct {
+	NodeID       string
+	Addr         string // Verified listening address, if any
+	Version      uint32 // Negotiated protocol version
+	Consensus    string
+	Heights      map[string]int
+	Capabilities map[string]bool
+}
+
+// Info returns the handshake information of a node, or nil.
+func (n *Node) Info(nodeID string) *PeerInfo {
+	n.peerInfosMu.Lock()
+	defer n.peerInfosMu.Unlock()
+	return n.peerInfos[nodeID]
+}
+
+// infoAt returns the handshake information of the node listening at addr,
+// or nil.
+func (n *Node) infoAt(addr string) *PeerInfo {
+	n.peerInfosMu.Lock()
+	defer n.peerInfosMu.Unlock()
+	for _, info := range n.peerInfos {
+		if info.Addr == addr {
+			return info
+		}
+	}
+	return nil
+}
+
+// recordInfo stores a node's handshake information. An unverified address
+// does not replace a verified one, and a verified address is taken away from
+// any node that was listening there before.
+func (n *Node) recordInfo(info *PeerInfo) {
+	n.peerInfosMu.Lock()
+	defer n.peerInfosMu.Unlock()
+	if info.Addr == "" {
+		if old := n.peerInfos[info.NodeID]; old != nil && old.Addr != "" {
+			verified := *info
+			verified.Addr = old.Addr
+			info = &verified
+		}
+	} else {
+		for nodeID, other := range n.peerInfos {
+			if nodeID != info.NodeID && other.Addr == info.Addr {
+				moved := *other
+				moved.Addr = ""
+				n.peerInfos[nodeID] = &moved
+			}
+		}
+	}
+	n.peerInfos[info.NodeID] = info
+}
+
+// supports reports whether the peer listening at addr has announced a
+// capability. Peers we have not completed a handshake with are assumed to
+// support nothing optional.
+func (n *Node) supports(addr, capability string) bool {
+	info := n.infoAt(addr)
+	return info != nil && info.Capabilities[capability]
+}
+
+func (n *Node) localVersion() versionMsg {
+	rooms := make(map[string]int)
+	for _, roomID := range n.Ledgers.Rooms() {
+		if chain, err := n.Ledgers.Chain(roomID); err == nil {
+			rooms[roomID] = chain[len(chain)-1].Index
+		}
+	}
+	return versionMsg{
+		Version:      ProtocolVersion,
+		NodeID:       n.id,
+		Addr:         n.LocalAddr,
+		Consensus:    consensus.Engine,
+		Rooms:        rooms,
+		Capabilities: Capabilities,
+	}
+}
+
+func (n *Node) sendVersion(p *Peer) error {
+	p.sentVersion = true
+	return p.Send("version", GobEncode(n.localVersion()))
+}
+
+// checkVersion decides whether to talk to a peer and at which version.
+func checkVersion(msg versionMsg) (uint32, error) {
+	if msg.Consensus != consensus.Engine {
+		return 0, fmt.Errorf("peer runs consensus %q, we run %q", msg.Consensus, consensus.Engine)
+	}
+	if msg.Version < MinProtocolVersion {
+		return 0, fmt.Errorf("peer protocol version %d is older than %d", msg.Version, MinProtocolVersion)
+	}
+	if msg.Version < ProtocolVersion {
+		return msg.Version, nil
+	}
+	return ProtocolVersion, nil
+}
+
+// handleVersion accepts or refuses a peer based on its version message.
+func (n *Node) handleVersion(p *Peer, payload []byte) {
+	var msg versionMsg
+	if !decode(p, payload, &msg, "version") {
+		return
+	}
+	if p.info != nil {
+		return // Duplicate version
+	}
+
+	if msg.NodeID != p.ID {
+		misbehave(p, PenaltyProtocol, fmt.Sprintf("claimed node ID %s but authenticated as %s", msg.NodeID, p.ID))
+		p.Close()
+		return
+	}
+	negotiated, err := checkVersion(msg)
+	if err != nil {
+		log.Printf("Refusing peer %s: %v\n", p.Addr, err)
+		p.Close()
+		return
+	}
+
+	// Only the address we dialed is known to lead to this node
+	info := &PeerInfo{
+		NodeID:       msg.NodeID,
+		Version:      negotiated,
+		Consensus:    msg.Consensus,
+		Heights:      msg.Rooms,
+		Capabilities: make(map[string]bool),
+	}
+	for _, capability := range msg.Capabilities {
+		info.Capabilities[capability] = true
+	}
+	if p.dialed {
+		info.Addr = p.Addr
+	}
+	p.info = info
+	n.recordInfo(info)
+	p.conn.SetDeadline(time.Time{}) // Handshake done
+	if msg.Addr != "" {
+		n.Peers.Add(msg.Addr)
+	}
+
+	// The hosted rooms double as the peer's initial subscription
+	rooms := make(map[string]bool, len(msg.Rooms))
+	for roomID := range msg.Rooms {
+		rooms[roomID] = true
+	}
+	n.subsMutex.Lock()
+	n.subscriptions[p.ID] = rooms
+	n.subsMutex.Unlock()
+
+	if !p.sentVersion {
+		if err := n.sendVersion(p); err != nil {
+			log.Printf("Error sending version to %s: %v\n", p.Addr, err)
+			return
+		}
+	}
+	if err := p.Send("verack", nil); err != nil {
+		log.Printf("Error sending verack to %s: %v\n", p.Addr, err)
+		return
+	}
+
+	// An inbound peer's advertised address is verified by dialing it; the
+	// handshake on that connection records it
+	if !p.dialed && msg.Addr != "" && msg.Addr != n.LocalAddr && p.ListenAddr() != msg.Addr {
+		n.spawn(func() {
+			if _, err := n.dialPeer(msg.Addr); err != nil {
+				log.Printf("Error verifying address %s of %s: %v\n", msg.Addr, p.ID, err)
+			}
+		})
+	}
+
+	hosted := make([]string, 0, len(msg.Rooms))
+	for roomID := range msg.Rooms {
+		hosted = append(hosted, roomID)
+	}
+	sort.Strings(hosted)
+	n.requestSnapshots(p, hosted)
+
+	// Catch up on shared rooms where the peer is ahead of us
+	if !info.Capabilities[CapSync] {
+		return
+	}
+	local := n.localVersion().Rooms
+	for _, roomID := range hosted {
+		if ours, ok := local[roomID]; ok && msg.Rooms[roomID] > ours {
+			n.requestHeaders(p, roomID)
+		}
+	}
+}
+
+// handleVerack records that the peer accepted our version.
+func handleVerack(p *Peer) {
+	p.acked = true
+}
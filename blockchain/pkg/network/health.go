@@ -0,0 +1,79 @@
+package network
+
+import (
+	"log"
+	"math/rand"
+	"time"
+)
+
+// pingMsg measures round-trip time; the pong echoes it back unchanged.
+type pingMsg struct {
+	Nonce uint64
+	Sent  int64 // Unix nanoseconds
+}
+
+// StartHealthChecks pings connected peers every interval, drops peers that
+// have been silent for three intervals and redials known peers whose
+// reconnect backoff has expired.
+func (n *Node) StartHealthChecks(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			n.checkPeers(interval)
+		}
+	}()
+}
+
+func (n *Node) checkPeers(interval time.Duration) {
+	for _, addr := range n.Peers.Stale(n.Peers.now().Add(-3 * interval)) {
+		log.Printf("Peer %s timed out\n", addr)
+		n.outboundMu.Lock()
+		p := n.outbound[addr]
+		n.outboundMu.Unlock()
+		if p != nil {
+			n.dropPeer(p)
+		} else {
+			n.Peers.Disconnected(addr)
+		}
+	}
+
+	n.outboundMu.Lock()
+	connected := make([]*Peer, 0, len(n.outbound))
+	for _, p := range n.outbound {
+		connected = append(connected, p)
+	}
+	n.outboundMu.Unlock()
+	for _, p := range connected {
+		ping := pingMsg{Nonce: rand.Uint64(), Sent: time.Now().UnixNano()}
+		if err := p.Send("ping", GobEncode(ping)); err != nil {
+			n.dropPeer(p)
+		}
+	}
+
+	for _, addr := range n.Peers.Reconnectable() {
+		go func(addr string) {
+			if _, err := n.dialPeer(addr); err != nil {
+				log.Printf("Reconnecting to %s failed: %v\n", addr, err)
+			}
+		}(addr)
+	}
+}
+
+func handlePing(p *Peer, payload []byte) {
+	var ping pingMsg
+	if !decode(p, payload, &ping, "ping") {
+		return
+	}
+	if err := p.Send("pong", payload); err != nil {
+		log.Printf("Error answering ping from %s: %v\n", p.Addr, err)
+	}
+}
+
+func (n *Node) handlePong(p *Peer, payload []byte) {
+	var pong pingMsg
+	if !decode(p, payload, &pong, "pong") {
+		return
+	}
+	n.Peers.RecordLatency(p.ListenAddr(), time.Since(time.Unix(0, pong.Sent)))
+}
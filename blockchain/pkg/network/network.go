@@ -3,13 +3,18 @@ package network
 import (
 	"bytes"
 	"encoding/gob"
+	"errors"
 	"fmt"
-	"io"
 	"log"
+	"math/rand"
 	"net"
+	"sort"
 	"sync"
 	"time"
 	"voting-blockchain/pkg/block"
+	"voting-blockchain/pkg/consensus"
+	"voting-blockchain/pkg/ledger"
+	"voting-blockchain/pkg/smartcontract"
 )
 
 // Addr holds a list of node addresses.
@@ -23,17 +28,144 @@ type Room struct {
 	Blockchain block.Blockchain
 }
 
+// BlockMsg carries a new block of a room.
+type BlockMsg struct {
+	RoomID string
+	Block  block.Block
+}
+
 const (
 	protocol      = "tcp"
-	commandLength = 12 // Fixed command length
+	commandLength = 12 // Fixed command length in the message header
 	udpPort       = 12345
 	udpTrigger    = "\x00" // Discovery trigger
 )
 
-var (
-	KnownNodes = []string{} // List of discovered nodes
-	mutex      sync.Mutex   // Protects KnownNodes
-)
+// Node is one node of the voting network: the ledgers it hosts, the peers
+// it knows and the state of its connections and gossip. Nodes share nothing,
+// so several can run in one process over their own transports. The exported
+// settings must be made before the node starts listening or dialing.
+type Node struct {
+	Ledgers   *ledger.Manager // Ledgers of the rooms this node hosts
+	Peers     *PeerManager
+	LocalAddr string // Address peers can reach this node at
+
+	HostNewRooms bool // Whether to host rooms announced by peers
+	MaxFanout    int  // Bounds how many peers an item is announced to
+
+	// FastSync makes the node bootstrap rooms hosted by its peers from
+	// snapshots instead of waiting to be sent their whole chain.
+	FastSync bool
+	// TrustedCheckpoints pins, by room, the hash of a checkpoint block that
+	// snapshots must lead to. Snapshots are only accepted for rooms listed
+	// here, as a peer could otherwise make up both a snapshot and the
+	// checkpoint committing to it.
+	TrustedCheckpoints map[string]string
+	// Mine computes the proof of work of blocks the node appends and returns
+	// their hash; consensus.ProofOfWork if nil.
+	Mine func(*block.Block) string
+	// Clock is the time records are stamped with and gossip expires in;
+	// time.Now if nil.
+	Clock func() time.Time
+	// Go runs work a handler starts in the background, such as catching up
+	// with a peer; on a goroutine of its own if nil. Simulations run it as
+	// part of their schedule instead.
+	Go func(func())
+	// Rand decides which peers items are gossiped to; the global source if
+	// nil. A *rand.Rand is not safe for concurrent use, so it is only set
+	// where one handler runs at a time, as in simulations.
+	Rand *rand.Rand
+
+	id        string // Node ID of this node
+	transport Transport
+
+	outbound   map[string]*Peer     // Persistent connections we dialed, by address
+	dialing    map[string]*dialCall // Dials in progress, by address
+	outboundMu sync.Mutex
+
+	peerInfos   map[string]*PeerInfo // Node ID -> handshake info
+	peerInfosMu sync.Mutex
+
+	subscriptions map[string]map[string]bool // Node ID -> hosted rooms
+	subsMutex     sync.Mutex
+
+	seenBlocks *seenCache
+	seenTxs    *seenCache
+	// Items requested with getdata that have not arrived yet
+	inFlightBlocks *seenCache
+	inFlightTxs    *seenCache
+
+	mempool   map[string]TxMsg // Announced transactions, by hash
+	mempoolMu sync.Mutex
+
+	pendingSnapshots   map[string]bool // Rooms a snapshot was asked for
+	pendingSnapshotsMu sync.Mutex
+}
+
+// NewNode creates a node that hosts the rooms in ledgers, connects to peers
+// over transport as nodeID and tells them to reach it at localAddr.
+func NewNode(ledgers *ledger.Manager, transport Transport, nodeID, localAddr string) *Node {
+	peers := NewPeerManager(DefaultMaxPeers)
+	peers.local = localAddr
+	n := &Node{
+		Ledgers:            ledgers,
+		Peers:              peers,
+		LocalAddr:          localAddr,
+		HostNewRooms:       true,
+		MaxFanout:          DefaultMaxFanout,
+		TrustedCheckpoints: make(map[string]string),
+		id:                 nodeID,
+		transport:          transport,
+		outbound:           make(map[string]*Peer),
+		dialing:            make(map[string]*dialCall),
+		peerInfos:          make(map[string]*PeerInfo),
+		subscriptions:      make(map[string]map[string]bool),
+		mempool:            make(map[string]TxMsg),
+		pendingSnapshots:   make(map[string]bool),
+	}
+	n.seenBlocks = newSeenCache(seenTTL, n.now)
+	n.seenTxs = newSeenCache(seenTTL, n.now)
+	n.inFlightBlocks = newSeenCache(inFlightTTL, n.now)
+	n.inFlightTxs = newSeenCache(inFlightTTL, n.now)
+	return n
+}
+
+// ID returns the node ID this node authenticates as.
+func (n *Node) ID() string {
+	return n.id
+}
+
+// now returns the node's time.
+func (n *Node) now() time.Time {
+	if n.Clock != nil {
+		return n.Clock()
+	}
+	return time.Now()
+}
+
+// spawn runs fn in the background.
+func (n *Node) spawn(fn func()) {
+	if n.Go != nil {
+		n.Go(fn)
+		return
+	}
+	go fn()
+}
+
+// shuffle puts addrs in random order.
+func (n *Node) shuffle(addrs []string) {
+	swap := func(i, j int) { addrs[i], addrs[j] = addrs[j], addrs[i] }
+	if n.Rand != nil {
+		n.Rand.Shuffle(len(addrs), swap)
+		return
+	}
+	rand.Shuffle(len(addrs), swap)
+}
+
+// Listen opens the node's listener for peer connections.
+func (n *Node) Listen(port string) (net.Listener, error) {
+	return n.transport.Listen(port)
+}
 
 // GetLocalIP returns the local IP address.
 func GetLocalIP() string {
@@ -52,14 +184,15 @@ func GetLocalIP() string {
 	return ""
 }
 
-// DiscoverNodes starts UDP discovery.
-func DiscoverNodes(port string) {
-	go udpReceiver(port)
-	udpSender(port)
+// DiscoverNodes starts UDP broadcast discovery of nodes on the local
+// network in the background.
+func (n *Node) DiscoverNodes(port string) {
+	go n.udpReceiver(port)
+	go udpSender(port)
 }
 
 // udpReceiver listens for UDP broadcasts.
-func udpReceiver(port string) {
+func (n *Node) udpReceiver(port string) {
 	addr, err := net.ResolveUDPAddr("udp", fmt.Sprintf(":%d", udpPort))
 	if err != nil {
 		log.Printf("Error resolving UDP: %v\n", err)
@@ -75,21 +208,18 @@ func udpReceiver(port string) {
 
 	buffer := make([]byte, 1024)
 	for {
-		n, remoteAddr, err := conn.ReadFromUDP(buffer)
+		size, remoteAddr, err := conn.ReadFromUDP(buffer)
 		if err != nil {
 			log.Printf("Error reading UDP: %v\n", err)
 			continue
 		}
 
-		data := string(buffer[:n])
+		data := string(buffer[:size])
 		if data == udpTrigger {
 			nodeAddr := fmt.Sprintf("%s:%s", remoteAddr.IP.String(), port)
-			mutex.Lock()
-			if !NodeIsKnown(nodeAddr) {
-				KnownNodes = append(KnownNodes, nodeAddr)
+			if n.Peers.Add(nodeAddr) {
 				fmt.Printf("Discovered node: %s\n", nodeAddr)
 			}
-			mutex.Unlock()
 		}
 	}
 }
@@ -144,169 +274,303 @@ func BytesToCmd(bytes []byte) string {
 	return string(cmd)
 }
 
-// HandleConnection routes incoming data.
-func HandleConnection(conn net.Conn, blockchain *[]block.Block) {
+// HandleConnection serves a peer's connection, routing every message it
+// sends until the connection closes.
+func (n *Node) HandleConnection(conn net.Conn) {
+	if err := n.Peers.AcceptInbound(conn.RemoteAddr()); err != nil {
+		log.Printf("Rejected connection from %s: %v\n", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	// The connection is closed once everything else is cleaned up
 	defer conn.Close()
-	request := make([]byte, 4096)
-	_, err := conn.Read(request)
+	defer n.Peers.InboundClosed()
+
+	// The TLS handshake and the peer's version must arrive in time
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	id, err := n.transport.PeerID(conn)
+	if err == nil && n.Peers.Banned(id) {
+		err = fmt.Errorf("node %s is banned", id)
+	}
 	if err != nil {
-		log.Println("Error reading request:", err)
+		log.Printf("Rejected connection from %s: %v\n", conn.RemoteAddr(), err)
+		return
+	}
+	p := &Peer{Addr: conn.RemoteAddr().String(), ID: id, node: n, conn: conn}
+	p.serve()
+}
+
+// dispatch routes a message to its handler.
+func (n *Node) dispatch(p *Peer, msg Message) {
+	switch msg.Command {
+	case "version":
+		n.handleVersion(p, msg.Payload)
+		return
+	case "verack":
+		handleVerack(p)
+		return
+	}
+	if p.info == nil {
+		misbehave(p, PenaltyProtocol, fmt.Sprintf("sent %q before completing the handshake", msg.Command))
+		p.Close()
 		return
 	}
 
-	command := BytesToCmd(request[:commandLength])
-	switch command {
+	switch msg.Command {
+	case "ping":
+		handlePing(p, msg.Payload)
+	case "pong":
+		n.handlePong(p, msg.Payload)
+	case "getaddr":
+		n.handleGetAddr(p)
 	case "addr":
-		HandleAddr(request[commandLength:])
+		n.HandleAddr(p, msg.Payload)
+	case "subscribe":
+		n.handleSubscribe(p, msg.Payload)
+	case "inv":
+		n.handleInv(p, msg.Payload)
+	case "getdata":
+		n.handleGetData(p, msg.Payload)
+	case "tx":
+		n.handleTx(p, msg.Payload)
 	case "block":
-		handleBlock(request[commandLength:], blockchain)
+		n.handleBlock(p, msg.Payload)
 	case "room":
-		handleRoom(request[commandLength:])
+		n.handleRoom(p, msg.Payload)
+	case "getheaders":
+		n.handleGetHeaders(p, msg.Payload)
+	case "headers":
+		n.handleHeaders(p, msg.Payload)
+	case "getblocks":
+		n.handleGetBlocks(p, msg.Payload)
+	case "blocks":
+		n.handleBlocks(p, msg.Payload)
+	case "getsnapshot":
+		n.handleGetSnapshot(p, msg.Payload)
+	case "snapshot":
+		n.handleSnapshot(p, msg.Payload)
 	default:
-		fmt.Println("Unknown command")
+		misbehave(p, PenaltyUnknown, fmt.Sprintf("unknown command %q", msg.Command))
 	}
 }
 
-// HandleAddr processes a list of node addresses.
-func HandleAddr(payload []byte) {
-	var buff bytes.Buffer
-	buff.Write(payload)
-	dec := gob.NewDecoder(&buff)
-
+// HandleAddr processes a list of node addresses. The first address is the
+// sender's own. Newly learned addresses are relayed to a few connected
+// peers, not to every known one, so they spread without flooding.
+func (n *Node) HandleAddr(p *Peer, payload []byte) {
 	var nodes Addr
-	err := dec.Decode(&nodes)
-	if err != nil {
-		log.Println("Error decoding addr:", err)
+	if !decode(p, payload, &nodes, "addr") {
+		return
+	}
+	if len(nodes.AddrList) > maxAddrs {
+		misbehave(p, PenaltyMalformed, fmt.Sprintf("addr with %d addresses", len(nodes.AddrList)))
 		return
 	}
 
-	mutex.Lock()
-	defer mutex.Unlock()
-
+	var learned []string
 	for _, node := range nodes.AddrList {
-		if !NodeIsKnown(node) && node != "" {
-			KnownNodes = append(KnownNodes, node)
+		if n.Peers.Add(node) {
+			learned = append(learned, node)
 		}
 	}
+	if len(learned) == 0 {
+		return
+	}
 
-	// Share updated list with other nodes
-	for _, node := range KnownNodes {
-		if len(nodes.AddrList) > 0 && node != nodes.AddrList[0] {
-			SendAddr(node)
+	relay := Addr{AddrList: append([]string{n.LocalAddr}, learned...)}
+	peers := n.connectedPeers()
+	n.shuffle(peers)
+	sent := 0
+	for _, peer := range peers {
+		if sent >= n.MaxFanout {
+			break
+		}
+		if peer == p.ListenAddr() || peer == nodes.AddrList[0] {
+			continue
 		}
+		n.sendData(peer, "addr", GobEncode(relay))
+		sent++
 	}
 
-	fmt.Println("Updated nodes:", KnownNodes)
+	log.Printf("Learned %d addresses from %s\n", len(learned), p.ListenAddr())
 }
 
-// NodeIsKnown checks if a node is already known.
-func NodeIsKnown(addr string) bool {
-	for _, node := range KnownNodes {
-		if node == addr {
-			return true
-		}
+// connectedPeers returns the addresses of the peers we hold a connection to.
+func (n *Node) connectedPeers() []string {
+	n.outboundMu.Lock()
+	defer n.outboundMu.Unlock()
+	addrs := make([]string, 0, len(n.outbound))
+	for addr := range n.outbound {
+		addrs = append(addrs, addr)
 	}
-	return false
+	sort.Strings(addrs)
+	return addrs
 }
 
-// handleBlock processes and validates a block.
-func handleBlock(payload []byte, blockchain *[]block.Block) {
-	var buff bytes.Buffer
-	buff.Write(payload)
-	dec := gob.NewDecoder(&buff)
-
-	var newBlock block.Block
-	err := dec.Decode(&newBlock)
-	if err != nil {
-		log.Println("Error decoding block:", err)
+// handleBlock validates a block against the state of its room's chain and
+// appends it to the chain.
+func (n *Node) handleBlock(p *Peer, payload []byte) {
+	var msg BlockMsg
+	if !decode(p, payload, &msg, "block") {
 		return
 	}
+	newBlock := msg.Block
+	n.seenBlocks.Add(newBlock.Hash)
 
+	if !n.Ledgers.Hosts(msg.RoomID) {
+		return // Not a room we host
+	}
 	if !block.ValidateBlock(&newBlock) {
-		fmt.Println("Invalid block. Ignored.")
+		misbehave(p, PenaltyInvalidBlock, fmt.Sprintf("invalid block %d for room %s", newBlock.Index, msg.RoomID))
 		return
 	}
 
-	mutex.Lock()
-	defer mutex.Unlock()
-
-	if len(*blockchain) > 0 && newBlock.PrevHash != (*blockchain)[len(*blockchain)-1].Hash {
-		fmt.Println("Block does not link to chain. Attempting to synchronize chain...")
-		// TODO: Request the full blockchain from the sender and replace local chain if longer and valid
-		// Example placeholder:
-		// senderAddr := newBlock.SourceAddr // You may need to include sender info in the block/network message
-		// receivedChain := RequestChainFromPeer(senderAddr)
-		// if len(receivedChain) > len(*blockchain) && block.ValidateBlockchain(receivedChain) {
-		//   *blockchain = receivedChain
-		//   fmt.Println("Chain synchronized with peer.")
-		// } else {
-		//   fmt.Println("Received chain is not valid or not longer. Ignoring block.")
-		// }
+	state, err := n.Ledgers.State(msg.RoomID)
+	if err != nil {
+		log.Printf("Error loading room %s: %v\n", msg.RoomID, err)
+		return
+	}
+	if state.Tip == newBlock.PrevHash {
+		if err := checkBlocks(state, []block.Block{newBlock}); err != nil {
+			misbehave(p, PenaltyInvalidBlock, fmt.Sprintf("rejected block for room %s: %v", msg.RoomID, err))
+			return
+		}
+		// The append fails if the tip moved since the state was taken
+		err = n.Ledgers.Append(msg.RoomID, newBlock)
+	}
+	if state.Tip != newBlock.PrevHash || err != nil {
+		if _, ok := n.findBlock(msg.RoomID, newBlock.Hash); ok {
+			return // Already have it
+		}
+		fmt.Printf("Block does not link to room '%s'. Attempting to synchronize chain...\n", msg.RoomID)
+		n.spawn(func() { n.requestHeaders(p, msg.RoomID) })
 		return
 	}
+	fmt.Printf("Block %d added to room '%s'.\n", newBlock.Index, msg.RoomID)
 
-	*blockchain = append(*blockchain, newBlock)
-	fmt.Println("Block added:", newBlock)
+	// Relay the new block and forget the transaction it mined
+	n.RemoveFromMempool(newBlock.Data)
+	n.announce(msg.RoomID, InvItem{Type: InvBlock, Hash: newBlock.Hash}, p.ListenAddr())
 }
 
-// handleRoom processes and saves a room's blockchain.
-func handleRoom(payload []byte) {
-	var buff bytes.Buffer
-	buff.Write(payload)
-	dec := gob.NewDecoder(&buff)
-
+// handleRoom processes a room's blockchain offered by a peer. The chain must
+// be valid, down to the records of the blocks we do not have; a room we
+// already host is only replaced if the offered chain shares its genesis
+// block and wins fork choice against the local one. A room bootstrapped
+// from a snapshot is compared from the checkpoint its chain starts at, and
+// keeps starting there.
+func (n *Node) handleRoom(p *Peer, payload []byte) {
 	var room Room
-	err := dec.Decode(&room)
-	if err != nil {
-		log.Printf("Error decoding room: %v\n", err)
+	if !decode(p, payload, &room, "room") {
+		return
+	}
+	if err := ledger.ValidRoomID(room.RoomID); err != nil {
+		misbehave(p, PenaltyProtocol, err.Error())
+		return
+	}
+	if len(room.Blockchain) == 0 || !block.ValidateBlockchain(room.Blockchain) {
+		misbehave(p, PenaltyInvalidBlock, fmt.Sprintf("invalid chain for room %s", room.RoomID))
 		return
 	}
 
-	filename := fmt.Sprintf("./ledgers/blockchain-%s.json", room.RoomID)
-	err = block.SaveBlockchain(filename, room.Blockchain)
+	newRoom := false
+	err := n.Ledgers.Update(room.RoomID, func(current block.Blockchain) (block.Blockchain, error) {
+		if current == nil {
+			if !n.HostNewRooms {
+				return nil, nil
+			}
+			if room.Blockchain[0].Index != 0 {
+				return nil, fmt.Errorf("chain for room %s does not start at genesis", room.RoomID)
+			}
+			if err := checkBlocks(smartcontract.NewState(), room.Blockchain); err != nil {
+				return nil, err
+			}
+			newRoom = true
+			return room.Blockchain, nil
+		}
+		base := indexOf(room.Blockchain, current[0].Hash)
+		if base < 0 {
+			return nil, fmt.Errorf("chain for room %s has a different genesis block", room.RoomID)
+		}
+		candidate := room.Blockchain[base:]
+		if !consensus.ActiveForkChoice(current, candidate) {
+			return nil, nil // Keep our chain
+		}
+		common := 0
+		for common < len(current) && common < len(candidate) && current[common].Hash == candidate[common].Hash {
+			common++
+		}
+		state, err := smartcontract.StateAt(current, common)
+		if err != nil {
+			return nil, err
+		}
+		if err := checkBlocks(state, candidate[common:]); err != nil {
+			return nil, err
+		}
+		fmt.Printf("Room '%s' switched to chain at height %d from %s.\n", room.RoomID, candidate[len(candidate)-1].Index, p.Addr)
+		return candidate, nil
+	})
+	var invalid invalidError
+	if errors.As(err, &invalid) {
+		misbehave(p, PenaltyInvalidBlock, fmt.Sprintf("rejected room %s: %v", room.RoomID, err))
+		return
+	}
 	if err != nil {
-		log.Printf("Error saving blockchain: %v\n", err)
+		log.Printf("Rejected room '%s' from %s: %v\n", room.RoomID, p.Addr, err)
 		return
 	}
 
-	fmt.Printf("Room '%s' saved.\n", room.RoomID)
+	if newRoom {
+		fmt.Printf("Room '%s' saved.\n", room.RoomID)
+		// Let peers know we now host the room
+		n.subscribeAll()
+	}
 }
 
-// SendBlock sends a block to a peer.
-func SendBlock(addr string, b *block.Block) {
-	data := GobEncode(b)
-	request := append(CmdToBytes("block"), data...)
-	sendData(addr, request)
+// SendBlock sends a room's block to a peer.
+func (n *Node) SendBlock(addr, roomID string, b *block.Block) {
+	n.sendData(addr, "block", GobEncode(BlockMsg{RoomID: roomID, Block: *b}))
 }
 
-// SendAddr sends known nodes to a peer.
-func SendAddr(addr string) {
-	nodes := Addr{AddrList: append(KnownNodes, addr)}
-	payload := GobEncode(nodes)
-	request := append(CmdToBytes("addr"), payload...)
-	sendData(addr, request)
+// SendAddr sends our address and the known nodes to a peer.
+func (n *Node) SendAddr(addr string) {
+	n.sendData(addr, "addr", GobEncode(n.addrList()))
 }
 
 // SendRoom sends a room's blockchain to a peer.
-func SendRoom(addr, roomID string, blockchain block.Blockchain) {
+func (n *Node) SendRoom(addr, roomID string, blockchain block.Blockchain) {
 	room := Room{RoomID: roomID, Blockchain: blockchain}
-	payload := GobEncode(room)
-	request := append(CmdToBytes("room"), payload...)
-	sendData(addr, request)
+	n.sendData(addr, "room", GobEncode(room))
 }
 
-// SendBlock sends a block to a peer
-func sendData(addr string, data []byte) {
-	conn, err := net.Dial(protocol, addr)
-	if err != nil {
-		fmt.Printf("Error connecting to %s: %v\n", addr, err)
-		return
+// BroadcastBlock sends a room's new block to the peers hosting the room.
+func (n *Node) BroadcastBlock(roomID string, b *block.Block) {
+	for _, peer := range n.Subscribers(roomID) {
+		n.SendBlock(peer, roomID, b)
 	}
-	defer conn.Close()
+}
 
-	_, err = io.Copy(conn, bytes.NewReader(data))
-	if err != nil {
+// AnnounceRoom offers a newly created room to every known peer.
+func (n *Node) AnnounceRoom(roomID string, blockchain block.Blockchain) {
+	for _, peer := range n.Peers.Addrs() {
+		n.SendRoom(peer, roomID, blockchain)
+	}
+}
+
+// sendData sends a message over the persistent connection to a peer,
+// redialing once if the connection has gone stale.
+func (n *Node) sendData(addr, command string, payload []byte) {
+	for attempt := 0; attempt < 2; attempt++ {
+		p, err := n.dialPeer(addr)
+		if err != nil {
+			log.Printf("Not sending %s to %s: %v\n", command, addr, err)
+			return
+		}
+		if err = p.Send(command, payload); err == nil {
+			return
+		}
 		log.Println("Error sending data:", err)
+		n.dropPeer(p)
 	}
 }
 
@@ -0,0 +1,171 @@
+package network
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// Peer is a persistent, framed connection to another node. Either side may
+// send messages at any time; replies travel over the same connection.
+type Peer struct {
+	Addr    string
+	ID      string // Node ID the peer authenticated with
+	node    *Node  // Node the connection belongs to
+	conn    net.Conn
+	writeMu sync.Mutex
+
+	dialed bool // Opened by us, so Addr is where the peer listens
+
+	// Handshake state, only touched by the goroutine serving the connection
+	// and, for sentVersion, by the dialer before serving starts
+	info        *PeerInfo
+	sentVersion bool
+	acked       bool
+}
+
+// Send writes a message to the peer.
+func (p *Peer) Send(command string, payload []byte) error {
+	p.writeMu.Lock()
+	defer p.writeMu.Unlock()
+	return WriteMessage(p.conn, command, payload)
+}
+
+// ListenAddr returns the address the peer accepts connections on, once
+// verified, or else the address of the connection.
+func (p *Peer) ListenAddr() string {
+	if addr := p.verifiedAddr(); addr != "" {
+		return addr
+	}
+	return p.Addr
+}
+
+// verifiedAddr returns the address the peer is known to accept connections
+// on, or "" if it has not been verified.
+func (p *Peer) verifiedAddr() string {
+	if p.dialed {
+		return p.Addr
+	}
+	if info := p.node.Info(p.ID); info != nil {
+		return info.Addr
+	}
+	return ""
+}
+
+// Close closes the underlying connection.
+func (p *Peer) Close() error {
+	return p.conn.Close()
+}
+
+// serve reads messages from the peer until the connection closes and routes
+// each one to its handler. The caller closes the connection once done.
+func (p *Peer) serve() {
+	reader := bufio.NewReader(p.conn)
+	for {
+		msg, err := ReadMessage(reader)
+		if err != nil {
+			if errors.Is(err, ErrInvalidFrame) {
+				misbehave(p, PenaltyMalformed, err.Error())
+			} else if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				log.Printf("Error reading from %s: %v\n", p.Addr, err)
+			}
+			return
+		}
+		p.node.Peers.Seen(p.ListenAddr())
+		p.node.dispatch(p, msg)
+	}
+}
+
+// dialCall is a dial in progress. Callers wanting the same address wait for
+// done and share its result.
+type dialCall struct {
+	done chan struct{}
+	peer *Peer
+	err  error
+}
+
+// dialPeer returns the persistent connection to addr, dialing it if needed.
+// The dial and handshake run without holding outboundMu, so a slow peer
+// only holds up those waiting for it.
+func (n *Node) dialPeer(addr string) (*Peer, error) {
+	n.outboundMu.Lock()
+	if p, ok := n.outbound[addr]; ok {
+		n.outboundMu.Unlock()
+		return p, nil
+	}
+	if call, ok := n.dialing[addr]; ok {
+		n.outboundMu.Unlock()
+		<-call.done
+		return call.peer, call.err
+	}
+	call := &dialCall{done: make(chan struct{})}
+	n.dialing[addr] = call
+	n.outboundMu.Unlock()
+
+	call.peer, call.err = n.dial(addr)
+
+	n.outboundMu.Lock()
+	delete(n.dialing, addr)
+	if call.err == nil {
+		n.outbound[addr] = call.peer
+		n.Peers.Connected(addr, call.peer.ID)
+	}
+	n.outboundMu.Unlock()
+	close(call.done)
+
+	if call.err == nil {
+		p := call.peer
+		go func() {
+			p.serve()
+			n.dropPeer(p)
+		}()
+	}
+	return call.peer, call.err
+}
+
+// dial connects to addr and opens the handshake.
+func (n *Node) dial(addr string) (*Peer, error) {
+	if err := n.Peers.CanDial(addr); err != nil {
+		return nil, err
+	}
+	conn, err := n.transport.Dial(addr)
+	if err != nil {
+		n.Peers.Failed(addr)
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	id, err := n.transport.PeerID(conn)
+	if err != nil {
+		conn.Close()
+		n.Peers.Failed(addr)
+		return nil, err
+	}
+	if n.Peers.Banned(id) {
+		conn.Close()
+		return nil, fmt.Errorf("peer %s is banned", id)
+	}
+	p := &Peer{Addr: addr, ID: id, node: n, conn: conn, dialed: true}
+
+	// Open with our version before anything else is sent
+	if err := n.sendVersion(p); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return p, nil
+}
+
+// dropPeer forgets a broken outbound connection so the next send redials.
+func (n *Node) dropPeer(p *Peer) {
+	n.outboundMu.Lock()
+	defer n.outboundMu.Unlock()
+	if n.outbound[p.Addr] == p {
+		delete(n.outbound, p.Addr)
+		n.Peers.Disconnected(p.Addr)
+	}
+	p.Close()
+}
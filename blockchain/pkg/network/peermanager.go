@@ -0,0 +1,410 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// PeerState is the connection state of a known peer.
+type PeerState string
+
+const (
+	StateDisconnected PeerState = "disconnected"
+	StateConnected    PeerState = "connected"
+	StateBanned       PeerState = "banned"
+)
+
+// Misbehaviour penalties. A peer whose score reaches BanThreshold is
+// disconnected and banned for BanDuration.
+const (
+	PenaltyMalformed    = 20  // Undecodable or oversized message
+	PenaltyUnknown      = 10  // Unknown command
+	PenaltyInvalidBlock = 50  // Block or chain that fails validation
+	PenaltyProtocol     = 100 // Handshake violation
+	BanThreshold        = 100
+
+	DefaultMaxPeers = 32
+	DefaultMaxKnown = 2000
+	BanDuration     = time.Hour
+	minBackoff      = time.Second
+	maxBackoff      = 5 * time.Minute
+	maxOffenders    = 10000 // Offenders without a record tracked at once
+)
+
+// PeerRecord is what the peer manager knows about one peer.
+type PeerRecord struct {
+	Addr        string        `json:"addr"`
+	NodeID      string        `json:"nodeId,omitempty"`
+	State       PeerState     `json:"state"`
+	Latency     time.Duration `json:"latency"`
+	LastSeen    time.Time     `json:"lastSeen"`
+	Score       int           `json:"score"`
+	BannedUntil time.Time     `json:"bannedUntil,omitempty"`
+	Failures    int           `json:"failures"`
+	NextAttempt time.Time     `json:"nextAttempt,omitempty"`
+	Static      bool          `json:"static,omitempty"` // Configured peer, always reconnected
+}
+
+// PeerManager tracks known peers, their health and their behaviour.
+type PeerManager struct {
+	MaxPeers int
+	MaxKnown int              // Known addresses kept, including disconnected ones
+	Clock    func() time.Time // Time backoff and bans are measured in, time.Now if nil
+
+	mu        sync.Mutex
+	peers     map[string]*PeerRecord // By listening address
+	bannedIDs map[string]time.Time   // Node ID -> ban expiry
+	bannedIPs map[string]time.Time   // IP -> ban expiry
+	offenders map[string]int         // Penalty points of peers without a record, by node ID or IP
+	inbound   int                    // Open inbound connections
+	local     string                 // Address of the node itself, never a peer
+}
+
+// NewPeerManager creates an empty peer manager.
+func NewPeerManager(maxPeers int) *PeerManager {
+	return &PeerManager{
+		MaxPeers:  maxPeers,
+		MaxKnown:  DefaultMaxKnown,
+		peers:     make(map[string]*PeerRecord),
+		bannedIDs: make(map[string]time.Time),
+		bannedIPs: make(map[string]time.Time),
+		offenders: make(map[string]int),
+	}
+}
+
+// Add records a peer address and reports whether it was new. Once MaxKnown
+// addresses are known, a new one replaces the least recently seen peer
+// that is neither connected nor static, and is dropped if there is none.
+func (m *PeerManager) Add(addr string) bool {
+	if addr == "" || addr == m.local {
+		return false
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.peers[addr]; ok {
+		return false
+	}
+	if !m.makeRoomLocked() {
+		return false
+	}
+	m.peers[addr] = &PeerRecord{Addr: addr, State: StateDisconnected}
+	return true
+}
+
+// AddStatic records a configured peer that the node always keeps connected.
+// Static peers are kept even beyond MaxKnown.
+func (m *PeerManager) AddStatic(addr string) {
+	if addr == "" || addr == m.local {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	rec, ok := m.peers[addr]
+	if !ok {
+		m.makeRoomLocked()
+		rec = &PeerRecord{Addr: addr, State: StateDisconnected}
+		m.peers[addr] = rec
+	}
+	rec.Static = true
+}
+
+// Known reports whether an address is known.
+func (m *PeerManager) Known(addr string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, ok := m.peers[addr]
+	return ok
+}
+
+// Addrs returns the addresses of all known peers that are not banned.
+func (m *PeerManager) Addrs() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var addrs []string
+	for addr, rec := range m.peers {
+		if !m.bannedLocked(rec, m.now()) {
+			addrs = append(addrs, addr)
+		}
+	}
+	sort.Strings(addrs)
+	return addrs
+}
+
+// Records returns a snapshot of every known peer.
+func (m *PeerManager) Records() []PeerRecord {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := m.now()
+	records := make([]PeerRecord, 0, len(m.peers))
+	for _, rec := range m.peers {
+		r := *rec
+		if m.bannedLocked(rec, now) {
+			r.State = StateBanned
+		}
+		records = append(records, r)
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].Addr < records[j].Addr })
+	return records
+}
+
+// CanDial reports why a peer should not be dialed right now, if at all.
+func (m *PeerManager) CanDial(addr string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := m.now()
+	rec, ok := m.peers[addr]
+	if !ok {
+		m.makeRoomLocked()
+		rec = &PeerRecord{Addr: addr, State: StateDisconnected}
+		m.peers[addr] = rec
+	}
+	if m.bannedLocked(rec, now) {
+		return fmt.Errorf("peer %s is banned", addr)
+	}
+	if now.Before(rec.NextAttempt) {
+		return fmt.Errorf("peer %s is backing off until %s", addr, rec.NextAttempt.Format(time.TimeOnly))
+	}
+	if rec.State != StateConnected && !rec.Static && m.connectedLocked() >= m.MaxPeers {
+		return errors.New("maximum number of peers reached")
+	}
+	return nil
+}
+
+// AcceptInbound reports whether an inbound connection may be served and,
+// if so, counts it until InboundClosed is called.
+func (m *PeerManager) AcceptInbound(remote net.Addr) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if until, ok := m.bannedIPs[hostOf(remote.String())]; ok && m.now().Before(until) {
+		return errors.New("address is banned")
+	}
+	if m.connectedLocked() >= m.MaxPeers {
+		return errors.New("maximum number of peers reached")
+	}
+	m.inbound++
+	return nil
+}
+
+// InboundClosed releases an inbound connection slot.
+func (m *PeerManager) InboundClosed() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.inbound--
+}
+
+// Connected marks a dialed peer as connected and resets its backoff.
+func (m *PeerManager) Connected(addr, nodeID string) {
+	m.update(addr, func(rec *PeerRecord) {
+		rec.State = StateConnected
+		rec.NodeID = nodeID
+		rec.Failures = 0
+		rec.NextAttempt = time.Time{}
+		rec.LastSeen = m.now()
+	})
+}
+
+// Disconnected marks a peer as no longer connected.
+func (m *PeerManager) Disconnected(addr string) {
+	m.update(addr, func(rec *PeerRecord) {
+		rec.State = StateDisconnected
+	})
+}
+
+// Failed records a failed dial and schedules the next attempt with
+// exponential backoff.
+func (m *PeerManager) Failed(addr string) {
+	m.update(addr, func(rec *PeerRecord) {
+		rec.State = StateDisconnected
+		rec.Failures++
+		backoff := minBackoff << uint(rec.Failures-1)
+		if backoff > maxBackoff || backoff <= 0 {
+			backoff = maxBackoff
+		}
+		rec.NextAttempt = m.now().Add(backoff)
+	})
+}
+
+// Seen records activity from a peer.
+func (m *PeerManager) Seen(addr string) {
+	m.update(addr, func(rec *PeerRecord) {
+		rec.LastSeen = m.now()
+	})
+}
+
+// RecordLatency stores a measured round-trip time.
+func (m *PeerManager) RecordLatency(addr string, rtt time.Duration) {
+	m.update(addr, func(rec *PeerRecord) {
+		rec.Latency = rtt
+	})
+}
+
+// Misbehaved adds penalty points to a peer and reports whether the peer is
+// now banned. addr is the peer's verified listening address, or "" if it
+// has none. Peers without a record are scored by node ID, or by IP if they
+// have not authenticated, and are not added as peers, as the address of
+// their connection is not one they can be dialed at.
+func (m *PeerManager) Misbehaved(addr, nodeID, remote string, points int) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	rec, ok := m.peers[addr]
+	if ok {
+		if nodeID != "" {
+			rec.NodeID = nodeID
+		}
+		nodeID = rec.NodeID
+		rec.Score += points
+		if rec.Score < BanThreshold {
+			return false
+		}
+		rec.Score = 0
+	} else {
+		key := "ip:" + hostOf(remote)
+		if nodeID != "" {
+			key = "id:" + nodeID
+		}
+		if _, tracked := m.offenders[key]; !tracked && len(m.offenders) >= maxOffenders {
+			for k := range m.offenders {
+				delete(m.offenders, k)
+				break
+			}
+		}
+		m.offenders[key] += points
+		if m.offenders[key] < BanThreshold {
+			return false
+		}
+		delete(m.offenders, key)
+	}
+
+	until := m.now().Add(BanDuration)
+	if ok {
+		rec.BannedUntil = until
+	}
+	if nodeID != "" {
+		m.bannedIDs[nodeID] = until
+	}
+	if host := hostOf(remote); host != "" {
+		m.bannedIPs[host] = until
+	}
+	return true
+}
+
+// Banned reports whether a node ID is currently banned.
+func (m *PeerManager) Banned(nodeID string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	until, ok := m.bannedIDs[nodeID]
+	return ok && m.now().Before(until)
+}
+
+// Stale returns connected peers that have not been heard from since cutoff.
+func (m *PeerManager) Stale(cutoff time.Time) []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var stale []string
+	for addr, rec := range m.peers {
+		if rec.State == StateConnected && rec.LastSeen.Before(cutoff) {
+			stale = append(stale, addr)
+		}
+	}
+	return stale
+}
+
+// Reconnectable returns disconnected peers whose backoff has expired, as
+// long as there is room for more connections.
+func (m *PeerManager) Reconnectable() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := m.now()
+	room := m.MaxPeers - m.connectedLocked()
+	var addrs []string
+	for addr, rec := range m.peers {
+		if rec.State != StateDisconnected || now.Before(rec.NextAttempt) || m.bannedLocked(rec, now) {
+			continue
+		}
+		// Static peers are always redialed; others only while there is room
+		if rec.Static || len(addrs) < room {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
+
+func (m *PeerManager) now() time.Time {
+	if m.Clock != nil {
+		return m.Clock()
+	}
+	return time.Now()
+}
+
+func (m *PeerManager) update(addr string, fn func(rec *PeerRecord)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if rec, ok := m.peers[addr]; ok {
+		fn(rec)
+	}
+}
+
+// makeRoomLocked evicts the least recently seen disconnected, non-static
+// peer if MaxKnown addresses are known, and reports whether there is room
+// for another.
+func (m *PeerManager) makeRoomLocked() bool {
+	if m.MaxKnown <= 0 || len(m.peers) < m.MaxKnown {
+		return true
+	}
+	var oldest *PeerRecord
+	for _, rec := range m.peers {
+		if rec.Static || rec.State == StateConnected {
+			continue
+		}
+		if oldest == nil || rec.LastSeen.Before(oldest.LastSeen) {
+			oldest = rec
+		}
+	}
+	if oldest == nil {
+		return false
+	}
+	delete(m.peers, oldest.Addr)
+	return true
+}
+
+func (m *PeerManager) connectedLocked() int {
+	n := m.inbound
+	for _, rec := range m.peers {
+		if rec.State == StateConnected {
+			n++
+		}
+	}
+	return n
+}
+
+func (m *PeerManager) bannedLocked(rec *PeerRecord, now time.Time) bool {
+	if now.Before(rec.BannedUntil) {
+		return true
+	}
+	until, ok := m.bannedIDs[rec.NodeID]
+	return rec.NodeID != "" && ok && now.Before(until)
+}
+
+func hostOf(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return ""
+	}
+	return host
+}
+
+// misbehave penalizes the peer behind a connection, dropping it once banned.
+func misbehave(p *Peer, points int, reason string) {
+	addr := p.ListenAddr()
+	log.Printf("Peer %s misbehaved: %s\n", addr, reason)
+	if p.node.Peers.Misbehaved(p.verifiedAddr(), p.ID, p.conn.RemoteAddr().String(), points) {
+		log.Printf("Banned peer %s for %s\n", addr, BanDuration)
+		p.Close()
+	}
+}
@@ -0,0 +1,61 @@
+package network
+
+import (
+	"fmt"
+	"voting-blockchain/pkg/block"
+	"voting-blockchain/pkg/consensus"
+	"voting-blockchain/pkg/smartcontract"
+)
+
+// RejectedError is returned by AppendRecord when a record fails validation
+// against the state of its room.
+type RejectedError struct {
+	Err error
+}
+
+func (e RejectedError) Error() string { return e.Err.Error() }
+
+func (e RejectedError) Unwrap() error { return e.Err }
+
+// AppendRecord builds a record from a room's latest state, validates it,
+// announces it to peers as a pending transaction, mines it into a new block
+// and appends it, then announces the block. Appends to a room are
+// serialized, so concurrent records are never mined on the same tip.
+func (n *Node) AppendRecord(roomID string, build func(*smartcontract.State) (block.VoteData, error)) (block.Block, error) {
+	newBlock, err := n.Ledgers.Extend(roomID, func(chain block.Blockchain, state *smartcontract.State) (block.Block, error) {
+		data, err := build(state)
+		if err != nil {
+			return block.Block{}, err
+		}
+		tip := chain[len(chain)-1]
+		b := block.Block{
+			Index:     tip.Index + 1,
+			Timestamp: n.now().Unix(),
+			Data:      data,
+			PrevHash:  tip.Hash,
+		}
+		if err := state.Validate(data, b.Timestamp); err != nil {
+			return block.Block{}, RejectedError{err}
+		}
+		n.AnnounceTx(roomID, data)
+		b.Hash = n.mine(&b)
+		if !block.ValidateBlock(&b) {
+			return b, fmt.Errorf("new block is invalid")
+		}
+		return b, nil
+	})
+	n.RemoveFromMempool(newBlock.Data) // Mined, or not going to be
+	if err != nil {
+		return newBlock, err
+	}
+	n.AnnounceBlock(roomID, &newBlock)
+	return newBlock, nil
+}
+
+// mine computes the proof of work of a new block and returns its hash.
+func (n *Node) mine(b *block.Block) string {
+	if n.Mine != nil {
+		return n.Mine(b)
+	}
+	return consensus.ProofOfWork(b)
+}
@@ -0,0 +1,185 @@
+package network
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"voting-blockchain/pkg/block"
+	"voting-blockchain/pkg/ledger"
+	"voting-blockchain/pkg/smartcontract"
+)
+
+// Fast bootstrap. A node that learns of a room it does not host asks a peer
+// for a snapshot with getsnapshot. The peer answers with the room state as of
+// its latest checkpoint block and the blocks from that checkpoint to its tip,
+// or with the whole chain if the room has no checkpoint yet. The node checks
+// that the blocks lead to a checkpoint it trusts, the state against the root
+// committed in the checkpoint and every block against the state, and starts
+// the room's ledger there; later blocks are synchronized as usual. Rooms
+// without a trusted checkpoint are asked for from genesis, and every block
+// is validated.
+type getSnapshotMsg struct {
+	RoomID      string
+	FromGenesis bool // Whether to send the chain from genesis, without a snapshot
+}
+
+type snapshotMsg struct {
+	RoomID string
+	State  []byte        // JSON state before Blocks[0], empty if Blocks starts at genesis
+	Blocks []block.Block // From the checkpoint, or genesis, towards the tip
+}
+
+// requestSnapshots asks a peer for snapshots of the rooms it hosts that we
+// do not host or have already asked for.
+func (n *Node) requestSnapshots(p *Peer, rooms []string) {
+	if !n.FastSync || !n.HostNewRooms || !p.info.Capabilities[CapSnapshot] {
+		return
+	}
+	for _, roomID := range rooms {
+		if n.Ledgers.Hosts(roomID) {
+			continue
+		}
+		n.pendingSnapshotsMu.Lock()
+		pending := n.pendingSnapshots[roomID]
+		n.pendingSnapshots[roomID] = true
+		n.pendingSnapshotsMu.Unlock()
+		if pending {
+			continue
+		}
+		_, trusted := n.TrustedCheckpoints[roomID]
+		if err := p.Send("getsnapshot", GobEncode(getSnapshotMsg{RoomID: roomID, FromGenesis: !trusted})); err != nil {
+			log.Printf("Error requesting snapshot of room %s from %s: %v\n", roomID, p.Addr, err)
+			n.doneSnapshot(roomID)
+		}
+	}
+}
+
+func (n *Node) doneSnapshot(roomID string) {
+	n.pendingSnapshotsMu.Lock()
+	defer n.pendingSnapshotsMu.Unlock()
+	delete(n.pendingSnapshots, roomID)
+}
+
+// handleGetSnapshot replies with the state of a room at its latest
+// checkpoint and the blocks that follow it, or with the blocks from genesis
+// if asked to.
+func (n *Node) handleGetSnapshot(p *Peer, payload []byte) {
+	var req getSnapshotMsg
+	if !decode(p, payload, &req, "getsnapshot") {
+		return
+	}
+
+	reply := snapshotMsg{RoomID: req.RoomID}
+	chain := n.loadRoomChain(req.RoomID)
+	start := -1
+	if !req.FromGenesis {
+		start = smartcontract.LatestCheckpoint(chain)
+	}
+	if start >= 0 {
+		state, err := smartcontract.StateAt(chain, start)
+		if err == nil {
+			reply.State, err = json.Marshal(state)
+		}
+		if err != nil {
+			log.Printf("Error taking snapshot of room %s: %v\n", req.RoomID, err)
+			return
+		}
+	} else {
+		start = 0
+	}
+	end := len(chain)
+	if end-start > maxHeaders {
+		end = start + maxHeaders
+	}
+	// Peers validate every block, so archived ones are sent in full
+	blocks, err := n.Ledgers.Restore(req.RoomID, chain[start:end])
+	if err != nil {
+		log.Printf("Error restoring archived blocks of room %s: %v\n", req.RoomID, err)
+		return
+	}
+	reply.Blocks = blocks
+	if err := p.Send("snapshot", GobEncode(reply)); err != nil {
+		log.Printf("Error sending snapshot to %s: %v\n", p.Addr, err)
+	}
+}
+
+// handleSnapshot verifies a snapshot and starts the room's ledger from it.
+func (n *Node) handleSnapshot(p *Peer, payload []byte) {
+	var msg snapshotMsg
+	if !decode(p, payload, &msg, "snapshot") {
+		return
+	}
+	defer n.doneSnapshot(msg.RoomID)
+	if len(msg.Blocks) == 0 || !n.HostNewRooms || n.Ledgers.Hosts(msg.RoomID) {
+		return
+	}
+	if err := ledger.ValidRoomID(msg.RoomID); err != nil {
+		misbehave(p, PenaltyProtocol, err.Error())
+		return
+	}
+
+	err := n.bootstrapRoom(msg)
+	var invalid invalidError
+	if errors.As(err, &invalid) {
+		misbehave(p, PenaltyInvalidBlock, fmt.Sprintf("rejected snapshot of room %s: %v", msg.RoomID, err))
+		return
+	}
+	if err != nil {
+		log.Printf("Error bootstrapping room %s from %s: %v\n", msg.RoomID, p.Addr, err)
+		return
+	}
+	fmt.Printf("Room '%s' bootstrapped from %s at height %d.\n", msg.RoomID, p.Addr, msg.Blocks[len(msg.Blocks)-1].Index)
+
+	n.subscribeAll()
+	// A full batch means the peer may have more
+	if len(msg.Blocks) == maxHeaders {
+		n.spawn(func() { n.requestHeaders(p, msg.RoomID) })
+	}
+}
+
+// bootstrapRoom checks a snapshot and its blocks and hands them to the
+// ledger. Failed checks are returned as invalidError.
+func (n *Node) bootstrapRoom(msg snapshotMsg) error {
+	blocks := block.Blockchain(msg.Blocks)
+	for i := range blocks {
+		if !block.ValidateBlock(&blocks[i]) {
+			return invalidError{fmt.Errorf("block %d is invalid", blocks[i].Index)}
+		}
+		if i > 0 && (blocks[i].PrevHash != blocks[i-1].Hash || blocks[i].Index != blocks[i-1].Index+1) {
+			return invalidError{fmt.Errorf("block %d does not link to its predecessor", blocks[i].Index)}
+		}
+	}
+	if trusted, ok := n.TrustedCheckpoints[msg.RoomID]; ok && indexOf(blocks, trusted) < 0 {
+		return invalidError{fmt.Errorf("snapshot does not lead to trusted checkpoint %s", trusted)}
+	}
+
+	if len(msg.State) == 0 {
+		if blocks[0].Index != 0 || blocks[0].PrevHash != "0" {
+			return invalidError{fmt.Errorf("chain without a snapshot must start at genesis")}
+		}
+		if err := checkBlocks(smartcontract.NewState(), blocks); err != nil {
+			return err
+		}
+		return n.Ledgers.Update(msg.RoomID, func(current block.Blockchain) (block.Blockchain, error) {
+			if current != nil {
+				return nil, nil // Learned the room meanwhile
+			}
+			return blocks, nil
+		})
+	}
+	if _, ok := n.TrustedCheckpoints[msg.RoomID]; !ok {
+		return fmt.Errorf("no trusted checkpoint to verify the snapshot against")
+	}
+	state, err := smartcontract.DecodeState(msg.State)
+	if err != nil {
+		return invalidError{err}
+	}
+	if err := smartcontract.VerifySnapshot(state, blocks[0]); err != nil {
+		return invalidError{err}
+	}
+	if err := checkBlocks(state.Clone(), blocks); err != nil {
+		return err
+	}
+	return n.Ledgers.Bootstrap(msg.RoomID, state, blocks)
+}
@@ -0,0 +1,97 @@
+package network
+
+import (
+	"log"
+	"sort"
+)
+
+// Peers subscribe to the rooms they host so that room data is only sent to
+// nodes that keep the room's ledger. Subscriptions belong to the node ID the
+// peer authenticated with, and room data is sent to the node's verified
+// listening address.
+type subscribeMsg struct {
+	Addr  string   // Listening address of the subscriber, unused
+	Rooms []string // Rooms the subscriber hosts
+	Reply bool     // Set on the answer to a subscription
+}
+
+func (n *Node) localSubscription(reply bool) subscribeMsg {
+	return subscribeMsg{Addr: n.LocalAddr, Rooms: n.Ledgers.Rooms(), Reply: reply}
+}
+
+// Subscribe tells a peer which rooms this node hosts.
+func (n *Node) Subscribe(addr string) {
+	n.sendData(addr, "subscribe", GobEncode(n.localSubscription(false)))
+}
+
+// Subscribers returns the addresses of the peers hosting a room. Peers whose
+// address has not been verified yet are left out.
+func (n *Node) Subscribers(roomID string) []string {
+	n.subsMutex.Lock()
+	var nodeIDs []string
+	for nodeID, rooms := range n.subscriptions {
+		if rooms[roomID] && nodeID != n.id {
+			nodeIDs = append(nodeIDs, nodeID)
+		}
+	}
+	n.subsMutex.Unlock()
+
+	var peers []string
+	for _, nodeID := range nodeIDs {
+		if info := n.Info(nodeID); info != nil && info.Addr != "" && info.Addr != n.LocalAddr {
+			peers = append(peers, info.Addr)
+		}
+	}
+	sort.Strings(peers)
+	return peers
+}
+
+// subscribeAll tells every known peer, in the background, which rooms we
+// host.
+func (n *Node) subscribeAll() {
+	for _, peer := range n.Peers.Addrs() {
+		n.spawn(func() { n.Subscribe(peer) })
+	}
+}
+
+// sharedRooms returns the rooms hosted by both this node and a peer.
+func (n *Node) sharedRooms(nodeID string) []string {
+	n.subsMutex.Lock()
+	defer n.subsMutex.Unlock()
+
+	var rooms []string
+	for _, roomID := range n.Ledgers.Rooms() {
+		if n.subscriptions[nodeID][roomID] {
+			rooms = append(rooms, roomID)
+		}
+	}
+	return rooms
+}
+
+// handleSubscribe records a change in the rooms a peer hosts, answers with
+// our own, catches up on the rooms we share and, with FastSync, bootstraps
+// the rooms we do not host yet.
+func (n *Node) handleSubscribe(p *Peer, payload []byte) {
+	var msg subscribeMsg
+	if !decode(p, payload, &msg, "subscribe") {
+		return
+	}
+
+	rooms := make(map[string]bool, len(msg.Rooms))
+	for _, roomID := range msg.Rooms {
+		rooms[roomID] = true
+	}
+	n.subsMutex.Lock()
+	n.subscriptions[p.ID] = rooms
+	n.subsMutex.Unlock()
+
+	if !msg.Reply {
+		if err := p.Send("subscribe", GobEncode(n.localSubscription(true))); err != nil {
+			log.Printf("Error answering subscription of %s: %v\n", p.ID, err)
+		}
+	}
+	for _, roomID := range n.sharedRooms(p.ID) {
+		n.requestHeaders(p, roomID)
+	}
+	n.requestSnapshots(p, msg.Rooms)
+}
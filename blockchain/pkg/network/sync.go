@@ -0,0 +1,431 @@
+package network
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"log"
+	"voting-blockchain/pkg/block"
+	"voting-blockchain/pkg/consensus"
+	"voting-blockchain/pkg/smartcontract"
+)
+
+// Chain synchronization. A node that is behind or on a fork sends its
+// locator in getheaders, receives the headers that follow the best common
+// block in headers, and if those headers describe a better chain under the
+// active fork-choice rule it fetches the bodies with getblocks/blocks,
+// validates them and adopts the resulting chain.
+const maxHeaders = 2000 // Headers (and so blocks) per sync round
+
+// Header is a block without its data.
+type Header struct {
+	Index     int
+	Timestamp int64
+	PrevHash  string
+	Hash      string
+	Nonce     int
+}
+
+type getHeadersMsg struct {
+	RoomID  string
+	Locator []string // Block hashes from the tip backwards, exponentially spaced
+}
+
+type headersMsg struct {
+	RoomID  string
+	Headers []Header
+}
+
+type getBlocksMsg struct {
+	RoomID string
+	Hashes []string
+}
+
+type blocksMsg struct {
+	RoomID string
+	Blocks []block.Block
+}
+
+// loadRoomChain returns a room's chain, or nil if the node does not host it.
+func (n *Node) loadRoomChain(roomID string) block.Blockchain {
+	chain, err := n.Ledgers.Chain(roomID)
+	if err != nil {
+		return nil
+	}
+	return chain
+}
+
+// findBlock looks up a block of a hosted room by hash.
+func (n *Node) findBlock(roomID, hash string) (block.Block, bool) {
+	store, err := n.Ledgers.Store(roomID)
+	if err != nil {
+		return block.Block{}, false
+	}
+	b, err := store.BlockByHash(hash)
+	return b, err == nil
+}
+
+// sendableBlock looks up a block of a hosted room by hash for sending to a
+// peer. Peers validate every block, so an archived block is restored.
+func (n *Node) sendableBlock(roomID, hash string) (block.Block, bool) {
+	b, ok := n.findBlock(roomID, hash)
+	if !ok || !b.Archived {
+		return b, ok
+	}
+	restored, err := n.Ledgers.Restore(roomID, block.Blockchain{b})
+	if err != nil {
+		log.Printf("Error restoring archived block %d of room %s: %v\n", b.Index, roomID, err)
+		return block.Block{}, false
+	}
+	return restored[0], true
+}
+
+// SyncRoom asks a peer for the blocks of a room that this node is missing.
+func (n *Node) SyncRoom(addr, roomID string) {
+	p, err := n.dialPeer(addr)
+	if err != nil {
+		fmt.Printf("Error connecting to %s: %v\n", addr, err)
+		return
+	}
+	n.requestHeaders(p, roomID)
+}
+
+// SyncRooms synchronizes the rooms this node shares with a peer. Rooms the
+// peer's subscription is not known for yet are synchronized once it arrives.
+func (n *Node) SyncRooms(addr string) {
+	p, err := n.dialPeer(addr)
+	if err != nil {
+		fmt.Printf("Error connecting to %s: %v\n", addr, err)
+		return
+	}
+	for _, roomID := range n.sharedRooms(p.ID) {
+		n.requestHeaders(p, roomID)
+	}
+}
+
+func (n *Node) requestHeaders(p *Peer, roomID string) {
+	chain := n.loadRoomChain(roomID)
+
+	msg := getHeadersMsg{RoomID: roomID, Locator: locator(chain)}
+	if err := p.Send("getheaders", GobEncode(msg)); err != nil {
+		log.Printf("Error requesting headers from %s: %v\n", p.Addr, err)
+	}
+}
+
+// locator lists hashes from the tip back to genesis, dense near the tip and
+// exponentially sparser further back, so the common ancestor of two chains
+// can be found in one round trip.
+func locator(chain block.Blockchain) []string {
+	var hashes []string
+	step := 1
+	for i := len(chain) - 1; i >= 0; i -= step {
+		hashes = append(hashes, chain[i].Hash)
+		if len(hashes) >= 10 {
+			step *= 2
+		}
+	}
+	if len(chain) > 0 && hashes[len(hashes)-1] != chain[0].Hash {
+		hashes = append(hashes, chain[0].Hash)
+	}
+	return hashes
+}
+
+// handleGetHeaders replies with the headers following the best block the
+// requester's locator has in common with our chain.
+func (n *Node) handleGetHeaders(p *Peer, payload []byte) {
+	var req getHeadersMsg
+	if !decode(p, payload, &req, "getheaders") {
+		return
+	}
+
+	chain := n.loadRoomChain(req.RoomID)
+
+	start := 0
+	for _, hash := range req.Locator {
+		if i := indexOf(chain, hash); i >= 0 {
+			start = i + 1
+			break
+		}
+	}
+
+	reply := headersMsg{RoomID: req.RoomID}
+	for i := start; i < len(chain) && len(reply.Headers) < maxHeaders; i++ {
+		reply.Headers = append(reply.Headers, headerOf(chain[i]))
+	}
+	if err := p.Send("headers", GobEncode(reply)); err != nil {
+		log.Printf("Error sending headers to %s: %v\n", p.Addr, err)
+	}
+}
+
+// handleHeaders requests the bodies of announced headers if they extend our
+// chain, or a fork of it, into a better chain.
+func (n *Node) handleHeaders(p *Peer, payload []byte) {
+	var msg headersMsg
+	if !decode(p, payload, &msg, "headers") {
+		return
+	}
+	if len(msg.Headers) == 0 {
+		return
+	}
+
+	chain := n.loadRoomChain(msg.RoomID)
+
+	candidate, err := spliceHeaders(chain, msg.Headers)
+	if err != nil {
+		log.Printf("Rejected headers for room %s from %s: %v\n", msg.RoomID, p.Addr, err)
+		return
+	}
+	if !consensus.ActiveForkChoice(chain, candidate) && len(msg.Headers) < maxHeaders {
+		return
+	}
+
+	req := getBlocksMsg{RoomID: msg.RoomID}
+	for _, h := range msg.Headers {
+		req.Hashes = append(req.Hashes, h.Hash)
+	}
+	if err := p.Send("getblocks", GobEncode(req)); err != nil {
+		log.Printf("Error requesting blocks from %s: %v\n", p.Addr, err)
+	}
+}
+
+// handleGetBlocks replies with the requested blocks that we have.
+func (n *Node) handleGetBlocks(p *Peer, payload []byte) {
+	var req getBlocksMsg
+	if !decode(p, payload, &req, "getblocks") {
+		return
+	}
+	if len(req.Hashes) > maxHeaders {
+		req.Hashes = req.Hashes[:maxHeaders]
+	}
+
+	chain := n.loadRoomChain(req.RoomID)
+
+	var found block.Blockchain
+	for _, hash := range req.Hashes {
+		if i := indexOf(chain, hash); i >= 0 {
+			found = append(found, chain[i])
+		}
+	}
+	// Peers validate every block, so archived ones are sent in full
+	blocks, err := n.Ledgers.Restore(req.RoomID, found)
+	if err != nil {
+		log.Printf("Error restoring archived blocks of room %s: %v\n", req.RoomID, err)
+		return
+	}
+	reply := blocksMsg{RoomID: req.RoomID, Blocks: blocks}
+	if err := p.Send("blocks", GobEncode(reply)); err != nil {
+		log.Printf("Error sending blocks to %s: %v\n", p.Addr, err)
+	}
+}
+
+// handleBlocks validates received blocks and adopts the chain they form if
+// the active fork-choice rule prefers it over ours.
+func (n *Node) handleBlocks(p *Peer, payload []byte) {
+	var msg blocksMsg
+	if !decode(p, payload, &msg, "blocks") {
+		return
+	}
+	if len(msg.Blocks) == 0 {
+		return
+	}
+
+	var abandoned []block.Block
+	err := n.Ledgers.Update(msg.RoomID, func(chain block.Blockchain) (block.Blockchain, error) {
+		if chain == nil {
+			return nil, nil // Not a room we host
+		}
+		candidate, err := spliceBlocks(chain, msg.Blocks)
+		if err != nil || !consensus.ActiveForkChoice(chain, candidate) {
+			return nil, err
+		}
+		abandoned = abandonedBlocks(chain, candidate)
+		fmt.Printf("Room '%s' synchronized with %s at height %d.\n", msg.RoomID, p.Addr, candidate[len(candidate)-1].Index)
+		return candidate, nil
+	})
+	var invalid invalidError
+	if errors.As(err, &invalid) {
+		misbehave(p, PenaltyInvalidBlock, fmt.Sprintf("rejected blocks for room %s: %v", msg.RoomID, err))
+		return
+	}
+	if err != nil {
+		log.Printf("Error synchronizing room %s with %s: %v\n", msg.RoomID, p.Addr, err)
+		return
+	}
+	n.requeue(msg.RoomID, abandoned)
+
+	// A full batch means the peer may have more
+	if len(msg.Blocks) == maxHeaders {
+		n.spawn(func() { n.requestHeaders(p, msg.RoomID) })
+	}
+}
+
+// spliceHeaders checks that headers form a linked sequence attached to our
+// chain, or starting one at genesis if we have none, and returns the
+// resulting chain of header-only blocks for fork choice. Headers starting
+// at a genesis other than ours describe a different room under the same ID
+// and are refused, as are headers forking before the checkpoint a chain
+// bootstrapped from a snapshot trusts.
+func spliceHeaders(chain block.Blockchain, headers []Header) (block.Blockchain, error) {
+	fork := -1
+	first := headers[0]
+	genesis := first.Index == 0 && first.PrevHash == "0"
+	switch {
+	case len(chain) == 0:
+		if !genesis {
+			return nil, fmt.Errorf("headers do not start at genesis")
+		}
+	case genesis:
+		if chain[0].Index != 0 || chain[0].Hash != first.Hash {
+			return nil, fmt.Errorf("headers start at a different genesis")
+		}
+	default:
+		fork = indexOf(chain, first.PrevHash)
+		if fork < 0 {
+			return nil, fmt.Errorf("headers do not attach to the local chain")
+		}
+	}
+	if fork >= 0 && first.Index != chain[fork].Index+1 {
+		return nil, invalidError{fmt.Errorf("header %d does not follow block %d", first.Index, chain[fork].Index)}
+	}
+
+	candidate := append(block.Blockchain{}, chain[:fork+1]...)
+	for i, h := range headers {
+		if i > 0 && (h.PrevHash != headers[i-1].Hash || h.Index != headers[i-1].Index+1) {
+			return nil, invalidError{fmt.Errorf("header %d does not link to its predecessor", h.Index)}
+		}
+		candidate = append(candidate, block.Block{Index: h.Index, Timestamp: h.Timestamp, PrevHash: h.PrevHash, Hash: h.Hash, Nonce: h.Nonce})
+	}
+	return candidate, nil
+}
+
+// abandonedBlocks returns the blocks of chain that a reorg to candidate
+// drops, leaving out those whose record candidate has as well.
+func abandonedBlocks(chain, candidate block.Blockchain) []block.Block {
+	fork := 0
+	for fork < len(chain) && fork < len(candidate) && chain[fork].Hash == candidate[fork].Hash {
+		fork++
+	}
+	kept := make(map[string]bool)
+	for _, b := range candidate[fork:] {
+		kept[block.HashData(b.Data)] = true
+	}
+	var abandoned []block.Block
+	for _, b := range chain[fork:] {
+		if !kept[block.HashData(b.Data)] {
+			abandoned = append(abandoned, b)
+		}
+	}
+	return abandoned
+}
+
+// requeue returns the records of blocks dropped by a reorg to the mempool
+// and, in the background, appends those still valid on the new chain, so
+// records already accepted are not lost with the branch they were on.
+// Records the new chain rules out, such as a vote its voter has since cast
+// there, are dropped.
+func (n *Node) requeue(roomID string, blocks []block.Block) {
+	var records []block.VoteData
+	for _, b := range blocks {
+		if b.Archived {
+			continue // Only the archive has the full record
+		}
+		n.addToMempool(block.HashData(b.Data), TxMsg{RoomID: roomID, Data: b.Data})
+		records = append(records, b.Data)
+	}
+	if len(records) == 0 {
+		return
+	}
+	n.spawn(func() {
+		for _, data := range records {
+			_, err := n.AppendRecord(roomID, func(*smartcontract.State) (block.VoteData, error) {
+				return data, nil
+			})
+			var rejected RejectedError
+			if errors.As(err, &rejected) {
+				log.Printf("Dropped record of room %s abandoned by a reorg: %v\n", roomID, err)
+			} else if err != nil {
+				log.Printf("Error requeueing record of room %s: %v\n", roomID, err)
+			}
+		}
+	})
+}
+
+// spliceBlocks attaches received blocks to our chain at their fork point
+// and returns the resulting chain if every new block is valid against the
+// state of the chain it extends.
+func spliceBlocks(chain block.Blockchain, blocks []block.Block) (block.Blockchain, error) {
+	headers := make([]Header, len(blocks))
+	for i, b := range blocks {
+		headers[i] = headerOf(b)
+	}
+	if _, err := spliceHeaders(chain, headers); err != nil {
+		return nil, err
+	}
+
+	fork := indexOf(chain, blocks[0].PrevHash)
+	state, err := smartcontract.StateAt(chain, fork+1)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkBlocks(state, blocks); err != nil {
+		return nil, err
+	}
+	return append(append(block.Blockchain{}, chain[:fork+1]...), blocks...), nil
+}
+
+// invalidError is returned when a peer's blocks break the consensus rules,
+// as opposed to failing to be stored. Only invalid blocks are held against
+// the peer that sent them.
+type invalidError struct {
+	err error
+}
+
+func (e invalidError) Error() string { return e.err.Error() }
+
+// checkBlocks checks blocks in chain order against the consensus rules: each
+// must match its hash, meet the proof-of-work target and hold a record valid
+// against the state of the chain before it. state is the state before the
+// first block and is advanced past the valid ones.
+func checkBlocks(state *smartcontract.State, blocks []block.Block) error {
+	for i := range blocks {
+		b := &blocks[i]
+		if !block.ValidateBlock(b) {
+			return invalidError{fmt.Errorf("block %d is invalid", b.Index)}
+		}
+		if !consensus.ValidateProofOfWork(b) {
+			return invalidError{fmt.Errorf("block %d does not meet the proof-of-work target", b.Index)}
+		}
+		if err := state.Validate(b.Data, b.Timestamp); err != nil {
+			return invalidError{fmt.Errorf("block %d: %v", b.Index, err)}
+		}
+		state.Apply(*b)
+	}
+	return nil
+}
+
+func headerOf(b block.Block) Header {
+	return Header{Index: b.Index, Timestamp: b.Timestamp, PrevHash: b.PrevHash, Hash: b.Hash, Nonce: b.Nonce}
+}
+
+func indexOf(chain block.Blockchain, hash string) int {
+	for i := range chain {
+		if chain[i].Hash == hash {
+			return i
+		}
+	}
+	return -1
+}
+
+func gobDecode(payload []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(payload)).Decode(v)
+}
+
+// decode decodes a message payload, penalizing the peer if it is malformed.
+func decode(p *Peer, payload []byte, v interface{}, what string) bool {
+	if err := gobDecode(payload, v); err != nil {
+		misbehave(p, PenaltyMalformed, fmt.Sprintf("malformed %s: %v", what, err))
+		return false
+	}
+	return true
+}
@@ -0,0 +1,121 @@
+package network
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"time"
+	"voting-blockchain/pkg/cryptography"
+)
+
+// Transport opens and authenticates peer connections. Nodes use the TLS
+// transport made by NewTLSTransport; simulations pass NewNode an in-memory
+// one.
+type Transport interface {
+	// Listen accepts peer connections on a port.
+	Listen(port string) (net.Listener, error)
+	// Dial connects to a peer's address.
+	Dial(addr string) (net.Conn, error)
+	// PeerID returns the node ID the remote end of conn authenticated as.
+	PeerID(conn net.Conn) (string, error)
+}
+
+// Peer connections use TLS 1.3 with mutual authentication. Every node
+// presents a self-signed certificate for its ed25519 identity key; instead
+// of a CA, peers are authenticated by pinning those keys against an
+// allowlist. Without an allowlist (open mode) any peer that proves
+// ownership of a key is accepted, which still encrypts traffic but does not
+// keep strangers out.
+type tlsTransport struct {
+	config *tls.Config
+}
+
+// NewTLSTransport returns a transport making authenticated, encrypted
+// connections for the given node identity and allowlist of peer IDs. A nil
+// allowlist selects open mode; an empty one accepts no peer.
+func NewTLSTransport(identity *cryptography.Identity, allowlist map[string]bool) (Transport, error) {
+	cert, err := selfSignedCert(identity.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	verify := func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return errors.New("peer presented no certificate")
+		}
+		peerCert, err := x509.ParseCertificate(rawCerts[0])
+		if err != nil {
+			return err
+		}
+		if err := peerCert.CheckSignature(peerCert.SignatureAlgorithm, peerCert.RawTBSCertificate, peerCert.Signature); err != nil {
+			return fmt.Errorf("peer certificate is not self-signed: %v", err)
+		}
+		pub, ok := peerCert.PublicKey.(ed25519.PublicKey)
+		if !ok {
+			return errors.New("peer key is not ed25519")
+		}
+		if allowlist != nil && !allowlist[cryptography.KeyID(pub)] {
+			return fmt.Errorf("peer %s is not in the allowlist", cryptography.KeyID(pub))
+		}
+		return nil
+	}
+
+	config := &tls.Config{
+		Certificates:          []tls.Certificate{cert},
+		MinVersion:            tls.VersionTLS13,
+		ClientAuth:            tls.RequireAnyClientCert,
+		InsecureSkipVerify:    true, // Chain verification is replaced by key pinning
+		VerifyPeerCertificate: verify,
+	}
+	return tlsTransport{config: config}, nil
+}
+
+func (t tlsTransport) Listen(port string) (net.Listener, error) {
+	return tls.Listen(protocol, ":"+port, t.config)
+}
+
+func (t tlsTransport) Dial(addr string) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	return tls.DialWithDialer(dialer, protocol, addr, t.config)
+}
+
+func (tlsTransport) PeerID(conn net.Conn) (string, error) {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return "", errors.New("connection is not encrypted")
+	}
+	if err := tlsConn.Handshake(); err != nil {
+		return "", err
+	}
+	certs := tlsConn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return "", errors.New("peer presented no certificate")
+	}
+	pub, ok := certs[0].PublicKey.(ed25519.PublicKey)
+	if !ok {
+		return "", errors.New("peer key is not ed25519")
+	}
+	return cryptography.KeyID(pub), nil
+}
+
+func selfSignedCert(priv ed25519.PrivateKey) (tls.Certificate, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(10 * 365 * 24 * time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, priv.Public(), priv)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: priv}, nil
+}
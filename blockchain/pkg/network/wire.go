@@ -0,0 +1,90 @@
+package network
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Message frame layout:
+//
+//	magic (4) | version (1) | command (12) | length (4) | checksum (4) | payload
+//
+// Integers are big-endian and the checksum is the first four bytes of the
+// SHA-256 of the payload. Frames are self-delimiting, so any number of
+// messages can be sent over one connection.
+const (
+	magic        uint32 = 0x564f5445 // "VOTE"
+	frameVersion byte   = 1          // Version of the frame format, not of the protocol
+	headerLength        = 4 + 1 + commandLength + 4 + 4
+	maxPayload          = 64 << 20 // Upper bound on a single message
+)
+
+// ErrInvalidFrame marks messages that violate the frame format, as opposed
+// to I/O errors on the connection.
+var ErrInvalidFrame = errors.New("invalid frame")
+
+// Message is a single framed network message.
+type Message struct {
+	Command string
+	Payload []byte
+}
+
+// WriteMessage writes one framed message to w.
+func WriteMessage(w io.Writer, command string, payload []byte) error {
+	if len(payload) > maxPayload {
+		return fmt.Errorf("payload of %d bytes exceeds the %d byte limit", len(payload), maxPayload)
+	}
+
+	header := make([]byte, headerLength)
+	binary.BigEndian.PutUint32(header[0:4], magic)
+	header[4] = frameVersion
+	copy(header[5:5+commandLength], CmdToBytes(command))
+	binary.BigEndian.PutUint32(header[5+commandLength:9+commandLength], uint32(len(payload)))
+	copy(header[9+commandLength:], checksum(payload))
+
+	// A single write keeps concurrent frames from interleaving on the wire
+	_, err := w.Write(append(header, payload...))
+	return err
+}
+
+// ReadMessage reads one framed message from r. It returns io.EOF if the
+// connection was closed cleanly between messages.
+func ReadMessage(r io.Reader) (Message, error) {
+	header := make([]byte, headerLength)
+	if _, err := io.ReadFull(r, header); err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			return Message{}, fmt.Errorf("truncated message header: %w", err)
+		}
+		return Message{}, err
+	}
+
+	if binary.BigEndian.Uint32(header[0:4]) != magic {
+		return Message{}, fmt.Errorf("%w: bad magic", ErrInvalidFrame)
+	}
+	if header[4] != frameVersion {
+		return Message{}, fmt.Errorf("%w: unsupported frame version %d", ErrInvalidFrame, header[4])
+	}
+	command := BytesToCmd(header[5 : 5+commandLength])
+	length := binary.BigEndian.Uint32(header[5+commandLength : 9+commandLength])
+	if length > maxPayload {
+		return Message{}, fmt.Errorf("%w: %s message of %d bytes exceeds the %d byte limit", ErrInvalidFrame, command, length, maxPayload)
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return Message{}, fmt.Errorf("truncated %s message: %w", command, err)
+	}
+	if !bytes.Equal(header[9+commandLength:], checksum(payload)) {
+		return Message{}, fmt.Errorf("%w: %s message failed its checksum", ErrInvalidFrame, command)
+	}
+	return Message{Command: command, Payload: payload}, nil
+}
+
+func checksum(payload []byte) []byte {
+	sum := sha256.Sum256(payload)
+	return sum[:4]
+}
@@ -0,0 +1,205 @@
+package simnet
+
+import (
+	"fmt"
+	"math/rand"
+	"path/filepath"
+	"time"
+	"voting-blockchain/pkg/block"
+	"voting-blockchain/pkg/ledger"
+	"voting-blockchain/pkg/network"
+	"voting-blockchain/pkg/smartcontract"
+)
+
+// Port is the port simulated nodes listen on.
+const Port = "8594"
+
+// Node is a simulated voting node: a network.Node with ledgers of its own,
+// reaching the other nodes over the simulated network. Its node ID is its
+// host name.
+type Node struct {
+	*network.Node
+	Host string // Host name, as used in partitions
+	Addr string // Address the node listens on
+
+	net *Network
+}
+
+// AddNode adds a node on host and starts serving its connections. A host
+// only runs one node; adding it again returns the node it already runs.
+// The node runs on the simulation's clock and schedule, and its random
+// choices derive from the simulation's seed.
+func (n *Network) AddNode(host string) (*Node, error) {
+	if node := n.Node(host); node != nil {
+		return node, nil
+	}
+	addr := host + ":" + Port
+	ledgers := ledger.NewManager(filepath.Join(n.dir, host))
+	node := &Node{
+		Node: network.NewNode(ledgers, n.Transport(host, host), host, addr),
+		Host: host,
+		Addr: addr,
+		net:  n,
+	}
+	node.Peers.Clock = n.Time
+	node.Clock = n.Time
+	node.Mine = n.mine
+	node.Go = func(fn func()) { n.schedule(n.Now(), fn) }
+	n.mu.Lock()
+	node.Rand = rand.New(rand.NewSource(n.rng.Int63()))
+	n.mu.Unlock()
+
+	listener, err := node.Listen(Port)
+	if err != nil {
+		ledgers.Close()
+		return nil, fmt.Errorf("node on %s: %w", host, err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go node.HandleConnection(conn)
+		}
+	}()
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.nodes[host] = node
+	n.order = append(n.order, node)
+	return node, nil
+}
+
+// AddNodes adds count nodes on hosts named node-0, node-1, and so on after
+// any existing nodes.
+func (n *Network) AddNodes(count int) ([]*Node, error) {
+	start := len(n.Nodes())
+	nodes := make([]*Node, count)
+	for i := range nodes {
+		node, err := n.AddNode(fmt.Sprintf("node-%d", start+i))
+		if err != nil {
+			return nil, err
+		}
+		nodes[i] = node
+	}
+	return nodes, nil
+}
+
+// Node returns the node on a host, or nil.
+func (n *Network) Node(host string) *Node {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.nodes[host]
+}
+
+// Nodes returns the nodes in the order they were added.
+func (n *Network) Nodes() []*Node {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return append([]*Node(nil), n.order...)
+}
+
+// Link makes two nodes static peers of each other and connects them, as
+// configuring each with -peers would.
+func (n *Network) Link(a, b *Node) {
+	a.Peers.AddStatic(b.Addr)
+	b.Peers.AddStatic(a.Addr)
+	a.SyncRooms(b.Addr)
+}
+
+// Mesh links every pair of nodes.
+func (n *Network) Mesh() {
+	nodes := n.Nodes()
+	for i := range nodes {
+		for j := i + 1; j < len(nodes); j++ {
+			n.Link(nodes[i], nodes[j])
+		}
+	}
+}
+
+// Converged reports whether every node hosts a room with the same tip.
+func (n *Network) Converged(roomID string) bool {
+	tip := ""
+	for i, node := range n.Nodes() {
+		t := node.Tip(roomID)
+		if t == "" || (i > 0 && t != tip) {
+			return false
+		}
+		tip = t
+	}
+	return true
+}
+
+// CreateRoom starts a room on the node and offers it to its peers, as the
+// API does for a new room.
+func (nd *Node) CreateRoom(roomID string) error {
+	if err := ledger.ValidRoomID(roomID); err != nil {
+		return err
+	}
+	genesis := block.CreateRoomGenesisBlock(roomID)
+	genesis.Timestamp = nd.net.Unix()
+	nd.net.mine(genesis)
+	if err := nd.Ledgers.Create(roomID, *genesis); err != nil {
+		return err
+	}
+	nd.AnnounceRoom(roomID, block.Blockchain{*genesis})
+	return nil
+}
+
+// Cast appends a record to the node's room as the API does for a new
+// record.
+func (nd *Node) Cast(roomID string, data block.VoteData) (block.Block, error) {
+	return nd.AppendRecord(roomID, func(*smartcontract.State) (block.VoteData, error) {
+		return data, nil
+	})
+}
+
+// Vote casts a voter's choice on a ballot, revising their earlier vote if
+// they have one.
+func (nd *Node) Vote(roomID, ballotID, voterID, choiceID string) (block.Block, error) {
+	return nd.AppendRecord(roomID, func(state *smartcontract.State) (block.VoteData, error) {
+		return state.VoteRecord(ballotID, voterID, choiceID)
+	})
+}
+
+// Chain returns the node's chain of a room, or nil.
+func (nd *Node) Chain(roomID string) block.Blockchain {
+	chain, err := nd.Ledgers.Chain(roomID)
+	if err != nil {
+		return nil
+	}
+	return chain
+}
+
+// Tip returns the hash of the last block of a room, or "" if the node does
+// not host it.
+func (nd *Node) Tip(roomID string) string {
+	chain := nd.Chain(roomID)
+	if len(chain) == 0 {
+		return ""
+	}
+	return chain[len(chain)-1].Hash
+}
+
+// Results tallies a ballot as the node currently sees it.
+func (nd *Node) Results(roomID, ballotID string) (map[string]int64, error) {
+	state, err := nd.Ledgers.State(roomID)
+	if err != nil {
+		return nil, err
+	}
+	return state.Tally(ballotID), nil
+}
+
+// reconnect redials the node's static peers once their backoff expires, as
+// the health checks of a real node would, and catches up on shared rooms.
+func (nd *Node) reconnect() {
+	epoch := time.Unix(nd.net.Epoch, 0)
+	for _, rec := range nd.Peers.Records() {
+		if !rec.Static {
+			continue
+		}
+		addr := rec.Addr
+		nd.net.schedule(rec.NextAttempt.Sub(epoch), func() { nd.SyncRooms(addr) })
+	}
+}
@@ -0,0 +1,407 @@
+// Package simnet runs a network of voting nodes inside one process.
+//
+// Every simulated node is a network.Node with its own ledgers, running the
+// real handshake, gossip, sync and validation code over an in-memory
+// transport. Message delivery is driven by a virtual clock and a seeded
+// random source, which decide the latency and loss of every message;
+// partitions can be changed at any point of a run. The simulation delivers
+// one message at a time and waits for the receiving node to handle it
+// before delivering the next. Work nodes start in the background is run as
+// a scheduled event too, and their random choices come from the seed, so a
+// run depends on its seed alone: the same scenario delivers the same
+// messages in the same order every time. A scenario looks like:
+//
+//	sim := simnet.New(42, dir)
+//	defer sim.Close()
+//	nodes, _ := sim.AddNodes(5)
+//	sim.Mesh()
+//	sim.RunUntilIdle(0)
+//	nodes[0].CreateRoom("room1")
+//	sim.RunUntilIdle(0)
+//	sim.Partition([]string{"node-0", "node-1"}, []string{"node-2", "node-3", "node-4"})
+//	nodes[0].Vote("room1", "ballot1", "alice", "yes")
+//	nodes[3].Vote("room1", "ballot1", "bob", "no")
+//	sim.RunUntilIdle(0)
+//	sim.Heal()
+//	sim.RunUntilIdle(0)
+//	converged := sim.Converged("room1")
+//
+// Transport provides the in-memory connections, implementing
+// network.Transport.
+package simnet
+
+import (
+	"container/heap"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+	"voting-blockchain/pkg/block"
+	"voting-blockchain/pkg/consensus"
+)
+
+// Defaults for new simulations.
+const (
+	DefaultMinLatency = 10 * time.Millisecond
+	DefaultMaxLatency = 50 * time.Millisecond
+	DefaultDifficulty = consensus.MinDifficulty
+	DefaultEpoch      = 1700000000 // Unix time the virtual clock starts at
+)
+
+// Network is a simulated network. Its methods are safe for concurrent use,
+// but a simulation should be driven (Step, RunFor, RunUntilIdle, Start)
+// from one goroutine at a time.
+type Network struct {
+	// Difficulty is the number of leading zero hex digits simulated nodes
+	// mine blocks to. Nodes reject blocks below consensus.MinDifficulty.
+	Difficulty int
+	// Epoch is the Unix time block timestamps start counting from.
+	Epoch int64
+
+	dir string // Nodes keep their ledgers in a subdirectory per host
+
+	mu         sync.Mutex
+	idle       *sync.Cond // Signaled when busy drops to zero
+	busy       int        // Connections whose node has work it has not finished
+	rng        *rand.Rand
+	now        time.Duration
+	seq        uint64
+	queue      eventQueue
+	minLatency time.Duration
+	maxLatency time.Duration
+	dropRate   float64
+	groups     map[string]int              // Partition group of each host, nil when healed
+	lastAt     map[[2]string]time.Duration // Latest delivery per link, keeping links FIFO
+	listeners  map[string]*listener
+	conns      []*Conn // Dialing ends of every connection
+	nextPort   int
+	nodes      map[string]*Node
+	order      []*Node // Nodes in creation order
+}
+
+// New creates a simulated network whose random choices derive from seed.
+// Its nodes keep their ledgers in dir.
+func New(seed int64, dir string) *Network {
+	n := &Network{
+		Difficulty: DefaultDifficulty,
+		Epoch:      DefaultEpoch,
+		dir:        dir,
+		rng:        rand.New(rand.NewSource(seed)),
+		minLatency: DefaultMinLatency,
+		maxLatency: DefaultMaxLatency,
+		lastAt:     make(map[[2]string]time.Duration),
+		listeners:  make(map[string]*listener),
+		nextPort:   40000,
+		nodes:      make(map[string]*Node),
+	}
+	n.idle = sync.NewCond(&n.mu)
+	return n
+}
+
+// Close stops every node, closing its listener, connections and ledgers.
+func (n *Network) Close() error {
+	n.mu.Lock()
+	listeners := make([]*listener, 0, len(n.listeners))
+	for _, l := range n.listeners {
+		listeners = append(listeners, l)
+	}
+	conns := n.conns
+	nodes := append([]*Node(nil), n.order...)
+	n.mu.Unlock()
+
+	for _, l := range listeners {
+		l.Close()
+	}
+	for _, c := range conns {
+		c.shutdown()
+		c.peer.shutdown()
+	}
+	var first error
+	for _, node := range nodes {
+		if err := node.Ledgers.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// SetLatency sets the range message delays are drawn from.
+func (n *Network) SetLatency(min, max time.Duration) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if max < min {
+		max = min
+	}
+	n.minLatency, n.maxLatency = min, max
+}
+
+// SetDropRate sets the probability, between 0 and 1, that a message is lost.
+func (n *Network) SetDropRate(rate float64) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.dropRate = rate
+}
+
+// Partition splits the network into groups of hosts that can only reach
+// hosts in the same group. Hosts left out of every group end up together in
+// one extra group. Connections across groups break at both ends, as timed
+// out TCP connections would.
+func (n *Network) Partition(groups ...[]string) {
+	n.mu.Lock()
+	n.groups = make(map[string]int)
+	for i, group := range groups {
+		for _, host := range group {
+			n.groups[host] = i
+		}
+	}
+	var broken []*Conn
+	live := n.conns[:0]
+	for _, c := range n.conns {
+		if n.reachableLocked(hostOf(c.local), hostOf(c.remote)) {
+			live = append(live, c)
+		} else {
+			broken = append(broken, c)
+		}
+	}
+	n.conns = live
+	n.mu.Unlock()
+
+	for _, c := range broken {
+		c.shutdown()
+		c.peer.shutdown()
+	}
+}
+
+// Heal removes any partition. Like real nodes redialing lost peers, every
+// node then reconnects to the peers it was linked to, once the backoff from
+// dials that failed during the partition has expired, and catches up on the
+// rooms they share.
+func (n *Network) Heal() {
+	n.mu.Lock()
+	n.groups = nil
+	nodes := append([]*Node(nil), n.order...)
+	n.mu.Unlock()
+
+	for _, node := range nodes {
+		node.reconnect()
+	}
+}
+
+// Reachable reports whether messages from host a can currently reach host b.
+func (n *Network) Reachable(a, b string) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.reachableLocked(a, b)
+}
+
+func (n *Network) reachableLocked(a, b string) bool {
+	if n.groups == nil {
+		return true
+	}
+	groupOf := func(host string) int {
+		if group, ok := n.groups[host]; ok {
+			return group
+		}
+		return -1
+	}
+	return groupOf(a) == groupOf(b)
+}
+
+// Now returns the virtual time elapsed since the simulation started.
+func (n *Network) Now() time.Duration {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.now
+}
+
+// Unix returns the virtual time as Unix seconds.
+func (n *Network) Unix() int64 {
+	return n.Epoch + int64(n.Now()/time.Second)
+}
+
+// Time returns the virtual time. Nodes' peer managers run on it, so backoff
+// and bans expire as the simulation advances.
+func (n *Network) Time() time.Time {
+	return time.Unix(n.Epoch, 0).Add(n.Now())
+}
+
+// Pending returns the number of scheduled events.
+func (n *Network) Pending() int {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return len(n.queue)
+}
+
+// Step runs the next scheduled event, advancing the clock to it, and waits
+// for the nodes to handle any data it delivered. It returns false if
+// nothing is scheduled.
+func (n *Network) Step() bool {
+	n.mu.Lock()
+	if len(n.queue) == 0 {
+		n.mu.Unlock()
+		return false
+	}
+	ev := heap.Pop(&n.queue).(*event)
+	if ev.at > n.now {
+		n.now = ev.at
+	}
+	n.mu.Unlock()
+
+	// Events run unlocked so they can schedule further events
+	ev.fn()
+	n.waitHandled()
+	return true
+}
+
+// working records connections starting (delta 1) or finishing (delta -1)
+// to have work for their node.
+func (n *Network) working(delta int) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.busy += delta
+	if n.busy == 0 {
+		n.idle.Broadcast()
+	}
+}
+
+// waitHandled waits until the nodes have handled every delivered message
+// and cleaned up after every closed connection.
+func (n *Network) waitHandled() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for n.busy > 0 {
+		n.idle.Wait()
+	}
+}
+
+// RunFor runs every event due within d and advances the clock by d.
+func (n *Network) RunFor(d time.Duration) {
+	end := n.Now() + d
+	for {
+		n.mu.Lock()
+		due := len(n.queue) > 0 && n.queue[0].at <= end
+		n.mu.Unlock()
+		if !due {
+			break
+		}
+		n.Step()
+	}
+	n.mu.Lock()
+	if n.now < end {
+		n.now = end
+	}
+	n.mu.Unlock()
+}
+
+// RunUntilIdle runs events until none are left or until maxSteps have run.
+// It returns the number of steps taken. A maxSteps of 0 means no limit.
+func (n *Network) RunUntilIdle(maxSteps int) int {
+	steps := 0
+	for (maxSteps == 0 || steps < maxSteps) && n.Step() {
+		steps++
+	}
+	return steps
+}
+
+// Start drives the simulation in real time, advancing the virtual clock by
+// tick on every tick. It returns a function that stops the driver.
+func (n *Network) Start(tick time.Duration) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(tick)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				n.RunFor(tick)
+			}
+		}
+	}()
+	var once sync.Once
+	return func() { once.Do(func() { close(done) }) }
+}
+
+// send schedules fn to run when a message from host from arrives at host to.
+// Messages to unreachable hosts are not delivered and send returns false;
+// messages lost to the drop rate still count as sent. Reliable messages are
+// never dropped, only delayed.
+func (n *Network) send(from, to string, fn func(), reliable bool) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if !n.reachableLocked(from, to) {
+		return false
+	}
+	if !reliable && n.dropRate > 0 && n.rng.Float64() < n.dropRate {
+		return true
+	}
+	at := n.now + n.minLatency
+	if spread := n.maxLatency - n.minLatency; spread > 0 {
+		at += time.Duration(n.rng.Int63n(int64(spread) + 1))
+	}
+	// Links deliver in order, like the TCP connections they stand in for
+	link := [2]string{from, to}
+	if at < n.lastAt[link] {
+		at = n.lastAt[link]
+	}
+	n.lastAt[link] = at
+	n.scheduleLocked(at, fn)
+	return true
+}
+
+// schedule runs fn at virtual time at, or right away if that has passed.
+func (n *Network) schedule(at time.Duration, fn func()) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if at < n.now {
+		at = n.now
+	}
+	n.scheduleLocked(at, fn)
+}
+
+func (n *Network) scheduleLocked(at time.Duration, fn func()) {
+	n.seq++
+	heap.Push(&n.queue, &event{at: at, seq: n.seq, fn: fn})
+}
+
+// mine finds a nonce for b at the network's difficulty and returns its hash.
+// Nonces are tried in order rather than at random so blocks built from the
+// same record at the same virtual time are the same.
+func (n *Network) mine(b *block.Block) string {
+	prefix := strings.Repeat("0", n.Difficulty)
+	for nonce := 0; ; nonce++ {
+		b.Nonce = nonce
+		if hash := block.CalculateHash(b); strings.HasPrefix(hash, prefix) {
+			b.Hash = hash
+			return hash
+		}
+	}
+}
+
+// event is a scheduled callback. Events due at the same time run in the
+// order they were scheduled.
+type event struct {
+	at  time.Duration
+	seq uint64
+	fn  func()
+}
+
+type eventQueue []*event
+
+func (q eventQueue) Len() int { return len(q) }
+func (q eventQueue) Less(i, j int) bool {
+	if q[i].at != q[j].at {
+		return q[i].at < q[j].at
+	}
+	return q[i].seq < q[j].seq
+}
+func (q eventQueue) Swap(i, j int)       { q[i], q[j] = q[j], q[i] }
+func (q *eventQueue) Push(x interface{}) { *q = append(*q, x.(*event)) }
+func (q *eventQueue) Pop() interface{} {
+	old := *q
+	ev := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return ev
+}
@@ -0,0 +1,91 @@
+package simnet
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"voting-blockchain/pkg/consensus"
+)
+
+// Rooms created on one node reach every other over the real handshake and
+// room announcement, votes are gossiped to all of them, and after a
+// partition heals every node settles on the side with more work, with the
+// votes cast on the other side mined on top of it.
+func TestPartitionedNodesConverge(t *testing.T) {
+	sim := New(42, t.TempDir())
+	defer sim.Close()
+	nodes, err := sim.AddNodes(5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sim.Mesh()
+	sim.RunUntilIdle(0)
+
+	if err := nodes[0].CreateRoom("room1"); err != nil {
+		t.Fatal(err)
+	}
+	sim.RunUntilIdle(0)
+	if !sim.Converged("room1") {
+		t.Fatal("room did not reach every node")
+	}
+
+	if _, err := nodes[1].Vote("room1", "ballot1", "alice", "yes"); err != nil {
+		t.Fatal(err)
+	}
+	sim.RunUntilIdle(0)
+	if !sim.Converged("room1") {
+		t.Fatal("vote did not reach every node")
+	}
+
+	small := []string{"node-0", "node-1"}
+	large := []string{"node-2", "node-3", "node-4"}
+	sim.Partition(small, large)
+	if _, err := nodes[0].Vote("room1", "ballot1", "bob", "no"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := nodes[2+i].Vote("room1", "ballot1", fmt.Sprint("voter-", i), "yes"); err != nil {
+			t.Fatal(err)
+		}
+		sim.RunUntilIdle(0)
+	}
+	sim.RunUntilIdle(0)
+	if sim.Converged("room1") {
+		t.Fatal("votes crossed the partition")
+	}
+	for _, group := range [][]string{small, large} {
+		for _, host := range group[1:] {
+			if sim.Node(host).Tip("room1") != sim.Node(group[0]).Tip("room1") {
+				t.Fatalf("%s and %s disagree inside their partition", host, group[0])
+			}
+		}
+	}
+
+	// Fork choice picks the side with more work, whichever it is
+	want := sim.Node(small[0]).Chain("room1")
+	if other := sim.Node(large[0]).Chain("room1"); consensus.ActiveForkChoice(want, other) {
+		want = other
+	}
+
+	sim.Heal()
+	sim.RunUntilIdle(0)
+	if !sim.Converged("room1") {
+		for _, node := range sim.Nodes() {
+			t.Logf("%s: height %d, tip %s", node.Host, len(node.Chain("room1"))-1, node.Tip("room1"))
+		}
+		t.Fatal("nodes did not converge after the partition healed")
+	}
+	chain := nodes[0].Chain("room1")
+	if tip := want[len(want)-1]; len(chain) < len(want) || chain[tip.Index].Hash != tip.Hash {
+		t.Fatalf("nodes converged on %s, want the chain with more work through %s", nodes[0].Tip("room1"), tip.Hash)
+	}
+	results, err := nodes[0].Results("room1", "ballot1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// No vote is lost with the abandoned side
+	expected := map[string]int64{"yes": 4, "no": 1}
+	if !reflect.DeepEqual(results, expected) {
+		t.Fatalf("results are %v, want %v", results, expected)
+	}
+}
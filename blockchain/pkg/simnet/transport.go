@@ -0,0 +1,288 @@
+package simnet
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+	"voting-blockchain/pkg/network"
+)
+
+// ErrUnreachable is returned when dialing or writing to a host on the other
+// side of a partition.
+var ErrUnreachable = errors.New("host is unreachable")
+
+// Transport is an in-memory network.Transport for one simulated host. Data
+// written to its connections is delivered through the simulation, subject
+// to its latency, drop rate and partitions; a dropped write loses the whole
+// frame, as network.WriteMessage writes one frame per call. Connections must
+// be read from until they end, then closed: the simulation waits for
+// delivered data to be handled, and for a reader that saw its connection end
+// to close it, before it moves on.
+type Transport struct {
+	net  *Network
+	host string
+	id   string
+}
+
+var _ network.Transport = (*Transport)(nil)
+
+// Transport returns the transport of a host that authenticates as nodeID.
+func (n *Network) Transport(host, nodeID string) *Transport {
+	return &Transport{net: n, host: host, id: nodeID}
+}
+
+// Listen accepts connections on host:port.
+func (t *Transport) Listen(port string) (net.Listener, error) {
+	addr := t.host + ":" + port
+	t.net.mu.Lock()
+	defer t.net.mu.Unlock()
+	if _, ok := t.net.listeners[addr]; ok {
+		return nil, fmt.Errorf("address %s already in use", addr)
+	}
+	l := &listener{net: t.net, addr: addr, id: t.id, accept: make(chan *Conn, 16), done: make(chan struct{})}
+	t.net.listeners[addr] = l
+	return l, nil
+}
+
+// Dial connects to a listener. The connection is usable at once; the
+// listener accepts it once the simulation delivers it.
+func (t *Transport) Dial(addr string) (net.Conn, error) {
+	t.net.mu.Lock()
+	l, ok := t.net.listeners[addr]
+	if !ok {
+		t.net.mu.Unlock()
+		return nil, fmt.Errorf("dial %s: connection refused", addr)
+	}
+	t.net.nextPort++
+	local := t.host + ":" + strconv.Itoa(t.net.nextPort)
+	t.net.mu.Unlock()
+
+	client := newConn(t.net, local, addr, l.id)
+	server := newConn(t.net, addr, local, t.id)
+	client.peer, server.peer = server, client
+	t.net.mu.Lock()
+	t.net.conns = append(t.net.conns, client)
+	t.net.mu.Unlock()
+	sent := t.net.send(t.host, hostOf(addr), func() {
+		// The node accepting it has work until it reads from the connection
+		server.mu.Lock()
+		server.busyLocked()
+		server.mu.Unlock()
+		select {
+		case l.accept <- server:
+		default:
+			server.Close() // Backlog full
+		}
+	}, true)
+	if !sent {
+		return nil, fmt.Errorf("dial %s: %w", addr, ErrUnreachable)
+	}
+	return client, nil
+}
+
+// PeerID returns the node ID of the remote end of a simulated connection.
+func (t *Transport) PeerID(conn net.Conn) (string, error) {
+	c, ok := conn.(*Conn)
+	if !ok {
+		return "", errors.New("not a simulated connection")
+	}
+	return c.remoteID, nil
+}
+
+// Conn is one end of a simulated connection.
+type Conn struct {
+	net      *Network
+	local    string
+	remote   string
+	remoteID string
+	peer     *Conn
+
+	mu       sync.Mutex
+	cond     *sync.Cond
+	buf      bytes.Buffer
+	closed   bool // Closed at this end
+	eof      bool // Closed at the other end
+	busy     bool // The reader has work the simulation waits for
+	reading  bool // A reader has started reading
+	handling bool // The reader is handling data it read
+	finished bool // The reader saw the connection end
+}
+
+func newConn(n *Network, local, remote, remoteID string) *Conn {
+	c := &Conn{net: n, local: local, remote: remote, remoteID: remoteID}
+	c.cond = sync.NewCond(&c.mu)
+	return c
+}
+
+// Read blocks until data has been delivered or the connection is closed.
+// Data delivered before the other end closed is still read; a connection
+// closed at this end reads nothing more.
+func (c *Conn) Read(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.reading = true
+	c.handling = false
+	for c.buf.Len() == 0 && !c.closed && !c.eof {
+		// Coming back for more means everything delivered was handled
+		c.idleLocked()
+		c.cond.Wait()
+	}
+	if c.closed || c.buf.Len() == 0 {
+		// The reader is done once it has cleaned up and closed
+		c.finished = true
+		if c.closed {
+			return 0, net.ErrClosed
+		}
+		return 0, io.EOF
+	}
+	c.handling = true
+	return c.buf.Read(b)
+}
+
+// Write schedules b for delivery to the other end.
+func (c *Conn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	closed := c.closed
+	c.mu.Unlock()
+	if closed {
+		return 0, net.ErrClosed
+	}
+
+	data := append([]byte(nil), b...)
+	peer := c.peer
+	if !c.net.send(hostOf(c.local), hostOf(c.remote), func() { peer.deliver(data) }, false) {
+		// A partition breaks the connection like a timed out TCP stream
+		c.Close()
+		return 0, ErrUnreachable
+	}
+	return len(b), nil
+}
+
+func (c *Conn) deliver(data []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return
+	}
+	c.buf.Write(data)
+	c.busyLocked()
+	c.cond.Broadcast()
+}
+
+// busyLocked records that the reader has work to do.
+func (c *Conn) busyLocked() {
+	if !c.busy {
+		c.busy = true
+		c.net.working(1)
+	}
+}
+
+// idleLocked records that the reader has finished its work.
+func (c *Conn) idleLocked() {
+	if c.busy {
+		c.busy = false
+		c.net.working(-1)
+	}
+}
+
+// Close closes this end at once and the other end once the simulation
+// delivers the close, after any data written before it.
+func (c *Conn) Close() error {
+	if !c.shutdown() {
+		return nil
+	}
+	peer := c.peer
+	c.net.send(hostOf(c.local), hostOf(c.remote), func() { peer.hangup() }, true)
+	return nil
+}
+
+// shutdown closes this end, discarding data that has not been read, and
+// reports whether it was open. A reader waiting for data is woken and given
+// work, as it has to clean up; a reader that saw the connection end is done
+// once it closes it.
+func (c *Conn) shutdown() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	open := !c.closed
+	if open {
+		c.closed = true
+		c.buf.Reset()
+		c.cond.Broadcast()
+	}
+	switch {
+	case c.handling:
+		// The reader finds the connection closed when it comes back
+	case c.reading && !c.finished:
+		c.busyLocked()
+	default:
+		c.idleLocked()
+	}
+	return open
+}
+
+// hangup records that the other end closed. The reader has to clean up.
+func (c *Conn) hangup() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.eof = true
+	if !c.closed {
+		c.busyLocked()
+	}
+	c.cond.Broadcast()
+}
+
+func (c *Conn) LocalAddr() net.Addr  { return simAddr(c.local) }
+func (c *Conn) RemoteAddr() net.Addr { return simAddr(c.remote) }
+
+// Deadlines are not simulated.
+func (c *Conn) SetDeadline(time.Time) error      { return nil }
+func (c *Conn) SetReadDeadline(time.Time) error  { return nil }
+func (c *Conn) SetWriteDeadline(time.Time) error { return nil }
+
+type listener struct {
+	net    *Network
+	addr   string
+	id     string
+	accept chan *Conn
+	done   chan struct{}
+	once   sync.Once
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.accept:
+		return c, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *listener) Close() error {
+	l.once.Do(func() {
+		l.net.mu.Lock()
+		delete(l.net.listeners, l.addr)
+		l.net.mu.Unlock()
+		close(l.done)
+	})
+	return nil
+}
+
+func (l *listener) Addr() net.Addr { return simAddr(l.addr) }
+
+type simAddr string
+
+func (a simAddr) Network() string { return "sim" }
+func (a simAddr) String() string  { return string(a) }
+
+// hostOf strips the port from a host:port address.
+func hostOf(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
@@ -0,0 +1,200 @@
+package smartcontract
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"voting-blockchain/pkg/block"
+)
+
+// Ballot states. Ballots without any state record predate the lifecycle and
+// have the empty state, in which they accept votes until closed.
+const (
+	StateDraft     = "draft"
+	StateScheduled = "scheduled"
+	StateOpen      = "open"
+	StateClosed    = "closed"
+	StateTallied   = "tallied" // Reached by appending the outcome record
+	StateCancelled = "cancelled"
+)
+
+// transitions lists the states each state may move to through a state record.
+var transitions = map[string][]string{
+	"":             {StateDraft, StateScheduled, StateOpen, StateClosed, StateCancelled},
+	StateDraft:     {StateScheduled, StateOpen, StateCancelled},
+	StateScheduled: {StateDraft, StateOpen, StateCancelled},
+	StateOpen:      {StateClosed, StateCancelled},
+}
+
+// Transition is the payload of a state record, signed by an admin of the
+// room. StartTime and EndTime are unix seconds; scheduled ballots open at
+// their start time and open ballots close at their end time, as of the
+// first block timestamped at or after it, without a record of either.
+type Transition struct {
+	State     string `json:"state"`
+	StartTime int64  `json:"startTime,omitempty"`
+	EndTime   int64  `json:"endTime,omitempty"`
+}
+
+// Lifecycle is the current state of a ballot as replayed from the ledger.
+type Lifecycle struct {
+	State     string `json:"state"`
+	StartTime int64  `json:"startTime,omitempty"`
+	EndTime   int64  `json:"endTime,omitempty"`
+}
+
+// TransitionRecord builds the ledger record moving a ballot to a new state.
+func TransitionRecord(ballotID string, t Transition) (block.VoteData, error) {
+	payload, err := json.Marshal(t)
+	if err != nil {
+		return block.VoteData{}, err
+	}
+	return block.VoteData{BallotID: ballotID, Type: block.TxState, Payload: string(payload)}, nil
+}
+
+// Lifecycle returns the state of a ballot as of the last block applied.
+func (s *State) Lifecycle(ballotID string) Lifecycle {
+	return s.lookup(ballotID).Lifecycle
+}
+
+// LifecycleAt returns the state of a ballot at time t, in Unix seconds.
+func (s *State) LifecycleAt(ballotID string, t int64) Lifecycle {
+	return s.Lifecycle(ballotID).At(t)
+}
+
+// At returns the state at time t, in Unix seconds, once the start and end
+// times that have passed by then are applied.
+func (lc Lifecycle) At(t int64) Lifecycle {
+	if lc.State == StateScheduled && lc.StartTime <= t {
+		lc.State = StateOpen
+	}
+	if lc.State == StateOpen && lc.EndTime != 0 && lc.EndTime <= t {
+		lc.State = StateClosed
+	}
+	return lc
+}
+
+// advance moves every ballot to its state at time t, freezing the tally of
+// those that close.
+func (s *State) advance(t int64) {
+	for _, bs := range s.Ballots {
+		lc := bs.Lifecycle.At(t)
+		if lc.State == StateClosed {
+			s.close(bs)
+		}
+		bs.Lifecycle = lc
+	}
+}
+
+// Ballots returns the lifecycle of every ballot that has a state record.
+func Ballots(chain block.Blockchain) (map[string]Lifecycle, error) {
+	s, err := Replay(chain)
+	if err != nil {
+		return nil, err
+	}
+	return s.Managed(), nil
+}
+
+// Managed returns the lifecycle of every ballot that has a state record.
+func (s *State) Managed() map[string]Lifecycle {
+	ballots := make(map[string]Lifecycle)
+	for ballotID, bs := range s.Ballots {
+		if bs.Managed {
+			ballots[ballotID] = bs.Lifecycle
+		}
+	}
+	return ballots
+}
+
+// DueOutcomes returns the ballots that are closed at time now but have no
+// outcome record yet, ordered by ballot ID.
+func (s *State) DueOutcomes(now int64) []string {
+	var due []string
+	for ballotID, bs := range s.Ballots {
+		if bs.Lifecycle.At(now).State == StateClosed {
+			due = append(due, ballotID)
+		}
+	}
+	sort.Strings(due)
+	return due
+}
+
+// admits checks whether a ballot in this state accepts a record in a block
+// timestamped at, in Unix seconds.
+func (lc Lifecycle) admits(data block.VoteData, at int64) error {
+	switch data.Type {
+	case block.TxVote, block.TxRevote:
+		switch lc.State {
+		case "":
+			return nil
+		case StateOpen:
+			if lc.EndTime != 0 && at >= lc.EndTime {
+				return errors.New("voting has ended")
+			}
+			return nil
+		default:
+			return fmt.Errorf("ballot is %s, not open", lc.State)
+		}
+	case block.TxWeights, block.TxPolicy:
+		switch lc.State {
+		case "", StateDraft, StateScheduled:
+			return nil
+		default:
+			return fmt.Errorf("ballot is %s; it can no longer be configured", lc.State)
+		}
+	case block.TxDelegate, block.TxRevoke:
+		switch lc.State {
+		case StateClosed, StateTallied, StateCancelled:
+			return fmt.Errorf("ballot is %s", lc.State)
+		}
+		return nil
+	case block.TxOutcome:
+		if lc.State != StateClosed {
+			return errors.New("only closed ballots can be tallied")
+		}
+		return nil
+	}
+	return nil
+}
+
+func validateTransition(s *State, data block.VoteData, at int64) error {
+	if err := s.checkAdminSignature(data); err != nil {
+		return err
+	}
+	var t Transition
+	if err := json.Unmarshal([]byte(data.Payload), &t); err != nil {
+		return fmt.Errorf("invalid state transition: %v", err)
+	}
+	lc := s.LifecycleAt(data.BallotID, at)
+
+	allowed := false
+	for _, next := range transitions[lc.State] {
+		if next == t.State {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		current := lc.State
+		if current == "" {
+			current = "unmanaged"
+		}
+		return fmt.Errorf("ballot cannot move from %s to %s", current, t.State)
+	}
+
+	if t.State == StateScheduled && t.StartTime == 0 && lc.StartTime == 0 {
+		return errors.New("scheduled ballots need a start time")
+	}
+	start, end := lc.StartTime, lc.EndTime
+	if t.StartTime != 0 {
+		start = t.StartTime
+	}
+	if t.EndTime != 0 {
+		end = t.EndTime
+	}
+	if start != 0 && end != 0 && end <= start {
+		return errors.New("end time must be after start time")
+	}
+	return nil
+}
@@ -0,0 +1,277 @@
+package smartcontract
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"voting-blockchain/pkg/block"
+	"voting-blockchain/pkg/cryptography"
+)
+
+// Member roles. Every role may vote; admins also manage the membership.
+const (
+	RoleAdmin     = "admin"
+	RoleCandidate = "candidate"
+	RoleVoter     = "voter"
+)
+
+// Membership actions. Join and leave are taken by the user themselves, the
+// others by an admin of the room. Every change is signed by the user taking
+// it, with the ed25519 key they registered by joining; a join is signed with
+// the key it registers.
+const (
+	ActionJoin    = "join"    // Request to join, or accept an invitation
+	ActionLeave   = "leave"   // Leave the room, or withdraw a request or invitation
+	ActionApprove = "approve" // Admit a pending user
+	ActionReject  = "reject"  // Turn down a pending user
+	ActionInvite  = "invite"  // Invite a user; a pending user is admitted at once
+	ActionRemove  = "remove"  // Remove a member, request or invitation
+	ActionRole    = "role"    // Change a member's role
+)
+
+// Membership statuses
+const (
+	StatusPending = "pending" // Asked to join, awaiting an admin
+	StatusInvited = "invited" // Invited by an admin, awaiting the user
+	StatusMember  = "member"
+)
+
+// MembershipChange is the payload of a membership record. The user it applies
+// to is the record's VoterID.
+type MembershipChange struct {
+	Action    string `json:"action"`
+	Role      string `json:"role,omitempty"` // Role granted by approve, invite and role
+	By        string `json:"by,omitempty"`   // Admin taking an admin action
+	Key       string `json:"key,omitempty"`  // Hex public key registered by a join
+	Nonce     int64  `json:"nonce"`          // Changes signed with the same key before
+	Signature string `json:"signature"`      // Hex signature of SigningBody
+}
+
+// SigningBody returns what the signer of a change to userID signs: the
+// change without its signature, bound to the room it is made in.
+func (c MembershipChange) SigningBody(roomID, userID string) []byte {
+	c.Signature = ""
+	body, _ := json.Marshal(struct {
+		Room   string           `json:"room"`
+		UserID string           `json:"userId"`
+		Change MembershipChange `json:"change"`
+	}{roomID, userID, c})
+	return body
+}
+
+// Member is a user's standing in a room.
+type Member struct {
+	UserID string `json:"userId"`
+	Status string `json:"status"`
+	Role   string `json:"role,omitempty"`
+	Key    string `json:"key,omitempty"` // Key the user signs membership changes with
+}
+
+// Membership maps the users of a room to their standing. A room without
+// members is open: anyone may vote in it, and the first user to join becomes
+// its admin. Once a room has members only they may vote or delegate.
+type Membership map[string]Member
+
+// MembershipRecord builds the ledger record applying a change to userID.
+func MembershipRecord(userID string, change MembershipChange) (block.VoteData, error) {
+	payload, err := json.Marshal(change)
+	if err != nil {
+		return block.VoteData{}, err
+	}
+	return block.VoteData{Type: block.TxMember, VoterID: userID, Payload: string(payload)}, nil
+}
+
+// List returns the users with the given status, or every user if status is
+// empty, ordered by user ID.
+func (m Membership) List(status string) []Member {
+	members := []Member{}
+	for _, member := range m {
+		if status == "" || member.Status == status {
+			members = append(members, member)
+		}
+	}
+	sort.Slice(members, func(i, j int) bool { return members[i].UserID < members[j].UserID })
+	return members
+}
+
+// IsMember reports whether userID is a member of the room.
+func (m Membership) IsMember(userID string) bool {
+	return m[userID].Status == StatusMember
+}
+
+// Open reports whether the room has no members and so admits every voter.
+func (m Membership) Open() bool {
+	return m.count("") == 0
+}
+
+// count returns the number of members with a role, or of all members if
+// role is empty.
+func (m Membership) count(role string) int {
+	n := 0
+	for _, member := range m {
+		if member.Status == StatusMember && (role == "" || member.Role == role) {
+			n++
+		}
+	}
+	return n
+}
+
+// apply makes a change to userID, or reports why it cannot be made.
+func (m Membership) apply(userID string, c MembershipChange) error {
+	if userID == "" {
+		return errors.New("user id is required")
+	}
+	current, known := m[userID]
+
+	switch c.Action {
+	case ActionJoin, ActionLeave:
+		if c.By != "" && c.By != userID {
+			return fmt.Errorf("only %q can %s the room", userID, c.Action)
+		}
+	case ActionApprove, ActionReject, ActionInvite, ActionRemove, ActionRole:
+		if !m.IsMember(c.By) || m[c.By].Role != RoleAdmin {
+			return fmt.Errorf("%q is not an admin of this room", c.By)
+		}
+	default:
+		return fmt.Errorf("unknown membership action %q", c.Action)
+	}
+
+	role := c.Role
+	if role == "" {
+		role = RoleVoter
+	}
+	switch c.Action {
+	case ActionApprove, ActionInvite, ActionRole:
+		if role != RoleAdmin && role != RoleCandidate && role != RoleVoter {
+			return fmt.Errorf("unknown role %q", c.Role)
+		}
+	}
+
+	switch c.Action {
+	case ActionJoin:
+		switch {
+		case current.Status == StatusMember:
+			return fmt.Errorf("%q is already a member", userID)
+		case m.Open():
+			m[userID] = Member{UserID: userID, Status: StatusMember, Role: RoleAdmin, Key: c.Key}
+		case current.Status == StatusInvited:
+			m[userID] = Member{UserID: userID, Status: StatusMember, Role: current.Role, Key: c.Key}
+		case current.Status == StatusPending:
+			return fmt.Errorf("%q has already asked to join", userID)
+		default:
+			m[userID] = Member{UserID: userID, Status: StatusPending, Key: c.Key}
+		}
+	case ActionApprove:
+		if current.Status != StatusPending {
+			return fmt.Errorf("%q has not asked to join", userID)
+		}
+		m[userID] = Member{UserID: userID, Status: StatusMember, Role: role, Key: current.Key}
+	case ActionReject:
+		if current.Status != StatusPending {
+			return fmt.Errorf("%q has not asked to join", userID)
+		}
+		delete(m, userID)
+	case ActionInvite:
+		switch current.Status {
+		case StatusMember:
+			return fmt.Errorf("%q is already a member", userID)
+		case StatusPending:
+			m[userID] = Member{UserID: userID, Status: StatusMember, Role: role, Key: current.Key}
+		default:
+			m[userID] = Member{UserID: userID, Status: StatusInvited, Role: role}
+		}
+	case ActionRole:
+		if current.Status != StatusMember {
+			return fmt.Errorf("%q is not a member", userID)
+		}
+		if role != RoleAdmin && m.lastAdmin(userID) {
+			return errors.New("the room must keep at least one admin")
+		}
+		current.Role = role
+		m[userID] = current
+	case ActionLeave, ActionRemove:
+		if !known {
+			return fmt.Errorf("%q is not a member", userID)
+		}
+		if m.lastAdmin(userID) && m.count("") > 1 {
+			return errors.New("the room must keep at least one admin")
+		}
+		delete(m, userID)
+		// A room whose last member left starts over as an open room
+		if m.Open() {
+			for id := range m {
+				delete(m, id)
+			}
+		}
+	}
+	return nil
+}
+
+// checkSignature checks that a change to userID is signed with the key
+// entitled to make it, and with that key's next nonce, and returns the key.
+func (s *State) checkSignature(userID string, c MembershipChange) (string, error) {
+	signer := c.By
+	key := s.Members[c.By].Key
+	switch c.Action {
+	case ActionJoin:
+		signer, key = userID, c.Key
+	case ActionLeave:
+		signer, key = userID, s.Members[userID].Key
+	}
+	if key == "" {
+		return "", fmt.Errorf("%q has no key to sign the change with", signer)
+	}
+	if c.Nonce != s.Nonces[key] {
+		return "", fmt.Errorf("membership change has nonce %d, expected %d", c.Nonce, s.Nonces[key])
+	}
+	if !cryptography.VerifySignature(key, c.SigningBody(s.Room, userID), c.Signature) {
+		return "", fmt.Errorf("membership change is not signed by %q", signer)
+	}
+	return key, nil
+}
+
+// lastAdmin reports whether userID is the only admin of the room.
+func (m Membership) lastAdmin(userID string) bool {
+	member := m[userID]
+	return member.Status == StatusMember && member.Role == RoleAdmin && m.count(RoleAdmin) == 1
+}
+
+// clone returns a copy of the membership.
+func (m Membership) clone() Membership {
+	c := make(Membership, len(m))
+	for id, member := range m {
+		c[id] = member
+	}
+	return c
+}
+
+func validateMembership(s *State, data block.VoteData) error {
+	if data.BallotID != "" {
+		return errors.New("membership records belong to the room, not a ballot")
+	}
+	var c MembershipChange
+	if err := json.Unmarshal([]byte(data.Payload), &c); err != nil {
+		return fmt.Errorf("invalid membership change: %v", err)
+	}
+	if err := s.Members.clone().apply(data.VoterID, c); err != nil {
+		return err
+	}
+	_, err := s.checkSignature(data.VoterID, c)
+	return err
+}
+
+// checkMember rejects records by users outside a room that has members.
+func checkMember(s *State, voterID string) error {
+	m := s.Members
+	if m.Open() {
+		return nil
+	}
+	if voterID == "" {
+		return errors.New("voter id is required in rooms with members")
+	}
+	if !m.IsMember(voterID) {
+		return fmt.Errorf("%q is not a member of this room", voterID)
+	}
+	return nil
+}
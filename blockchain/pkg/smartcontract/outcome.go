@@ -0,0 +1,269 @@
+package smartcontract
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"voting-blockchain/pkg/block"
+	"voting-blockchain/pkg/cryptography"
+)
+
+// Majority rules for deciding the winner of a ballot
+const (
+	MajorityRelative = "relative" // The choice with the most votes wins
+	MajorityAbsolute = "absolute" // The winner needs more than half of the votes
+	MajoritySuper    = "super"    // The winner needs at least Supermajority of the votes
+)
+
+// Ratio is an exact fraction such as 2/3.
+type Ratio struct {
+	Num int64 `json:"num"`
+	Den int64 `json:"den"`
+}
+
+// Policy holds the outcome rules of a ballot. It is committed on-chain
+// before voting starts; ballots without one use DefaultPolicy.
+type Policy struct {
+	Quorum        int64  `json:"quorum,omitempty"`        // Minimum turnout, in votes or weight
+	QuorumRatio   *Ratio `json:"quorumRatio,omitempty"`   // Minimum turnout as a share of the registered weight
+	Majority      string `json:"majority"`                // One of the Majority* rules
+	Supermajority *Ratio `json:"supermajority,omitempty"` // Threshold for MajoritySuper
+	AbstainChoice string `json:"abstainChoice,omitempty"` // Choice counted as an abstention
+	AbstainQuorum bool   `json:"abstainQuorum,omitempty"` // Whether abstentions count towards the quorum
+	AllowRevision bool   `json:"allowRevision,omitempty"` // Whether voters may recast their vote while the ballot is open
+}
+
+// DefaultPolicy is a plain plurality vote without a quorum.
+var DefaultPolicy = Policy{Majority: MajorityRelative}
+
+// Outcome is the result of a closed ballot as evaluated by the node.
+type Outcome struct {
+	BallotID    string           `json:"ballotId"`
+	Results     map[string]int64 `json:"results"`
+	Turnout     int64            `json:"turnout"`
+	Abstentions int64            `json:"abstentions"`
+	QuorumMet   bool             `json:"quorumMet"`
+	Winner      string           `json:"winner,omitempty"`
+	Passed      bool             `json:"passed"`
+}
+
+// SignedOutcome is the payload of an outcome record: the outcome signed by
+// the node that evaluated it.
+type SignedOutcome struct {
+	Outcome   Outcome `json:"outcome"`
+	Signer    string  `json:"signer"`    // ID of the signing node
+	Signature string  `json:"signature"` // Signature of the JSON outcome
+}
+
+// Validate checks that the policy is consistent.
+func (p Policy) Validate() error {
+	if p.Quorum < 0 {
+		return errors.New("quorum cannot be negative")
+	}
+	if p.QuorumRatio != nil && (p.QuorumRatio.Den <= 0 || p.QuorumRatio.Num < 0 || p.QuorumRatio.Num > p.QuorumRatio.Den) {
+		return errors.New("quorum ratio must be between 0 and 1")
+	}
+	switch p.Majority {
+	case MajorityRelative, MajorityAbsolute:
+	case MajoritySuper:
+		if p.Supermajority == nil || p.Supermajority.Den <= 0 || p.Supermajority.Num <= 0 || p.Supermajority.Num > p.Supermajority.Den {
+			return errors.New("supermajority must be a ratio between 0 and 1")
+		}
+	default:
+		return fmt.Errorf("unknown majority rule %q", p.Majority)
+	}
+	return nil
+}
+
+// Record builds the ledger record committing the policy for a ballot.
+func (p Policy) Record(ballotID string) (block.VoteData, error) {
+	if err := p.Validate(); err != nil {
+		return block.VoteData{}, err
+	}
+	payload, err := json.Marshal(p)
+	if err != nil {
+		return block.VoteData{}, err
+	}
+	return block.VoteData{BallotID: ballotID, Type: block.TxPolicy, Payload: string(payload)}, nil
+}
+
+// FindPolicy returns the policy committed for a ballot, or DefaultPolicy.
+func FindPolicy(chain block.Blockchain, ballotID string) (Policy, error) {
+	s, err := Replay(chain)
+	if err != nil {
+		return Policy{}, err
+	}
+	return s.lookup(ballotID).policy(), nil
+}
+
+// policy returns the policy committed for the ballot, or DefaultPolicy.
+func (bs *BallotState) policy() Policy {
+	if bs.Policy == nil {
+		return DefaultPolicy
+	}
+	return *bs.Policy
+}
+
+// Evaluate tallies a ballot and applies its policy.
+func Evaluate(chain block.Blockchain, ballotID string) (Outcome, error) {
+	s, err := Replay(chain)
+	if err != nil {
+		return Outcome{}, err
+	}
+	return s.Evaluate(ballotID)
+}
+
+// Evaluate tallies a ballot and applies its policy.
+func (s *State) Evaluate(ballotID string) (Outcome, error) {
+	bs := s.lookup(ballotID)
+	policy := bs.policy()
+	results := s.Tally(ballotID)
+
+	outcome := Outcome{BallotID: ballotID, Results: results}
+	for choice, count := range results {
+		if policy.AbstainChoice != "" && choice == policy.AbstainChoice {
+			outcome.Abstentions += count
+		} else {
+			outcome.Turnout += count
+		}
+	}
+
+	quorumTurnout := outcome.Turnout
+	if policy.AbstainQuorum {
+		quorumTurnout += outcome.Abstentions
+	}
+	outcome.QuorumMet = quorumTurnout >= policy.Quorum
+	if policy.QuorumRatio != nil {
+		weights := bs.Weights
+		if weights == nil {
+			return Outcome{}, errors.New("quorum ratio requires a weight table")
+		}
+		var registered int64
+		for _, weight := range weights {
+			registered += weight
+		}
+		if quorumTurnout*policy.QuorumRatio.Den < registered*policy.QuorumRatio.Num {
+			outcome.QuorumMet = false
+		}
+	}
+
+	// Find the leading choice; a tie for first place has no winner
+	var leader string
+	var best int64
+	tied := false
+	for choice, count := range results {
+		if choice == policy.AbstainChoice && policy.AbstainChoice != "" {
+			continue
+		}
+		switch {
+		case count > best:
+			leader, best, tied = choice, count, false
+		case count == best:
+			tied = true
+		}
+	}
+	if leader == "" || tied || !outcome.QuorumMet {
+		return outcome, nil
+	}
+
+	switch policy.Majority {
+	case MajorityRelative:
+		outcome.Passed = true
+	case MajorityAbsolute:
+		outcome.Passed = 2*best > outcome.Turnout
+	case MajoritySuper:
+		outcome.Passed = best*policy.Supermajority.Den >= outcome.Turnout*policy.Supermajority.Num
+	}
+	if outcome.Passed {
+		outcome.Winner = leader
+	}
+	return outcome, nil
+}
+
+// OutcomeRecord evaluates a ballot and builds the record closing it, signed
+// by the node's identity.
+func OutcomeRecord(chain block.Blockchain, ballotID string, signer *cryptography.Identity) (block.VoteData, error) {
+	s, err := Replay(chain)
+	if err != nil {
+		return block.VoteData{}, err
+	}
+	return s.OutcomeRecord(ballotID, signer)
+}
+
+// OutcomeRecord evaluates a ballot against the state and builds the record
+// closing it.
+func (s *State) OutcomeRecord(ballotID string, signer *cryptography.Identity) (block.VoteData, error) {
+	outcome, err := s.Evaluate(ballotID)
+	if err != nil {
+		return block.VoteData{}, err
+	}
+	body, err := json.Marshal(outcome)
+	if err != nil {
+		return block.VoteData{}, err
+	}
+	if signer == nil {
+		return block.VoteData{}, errors.New("outcome records must be signed by the node")
+	}
+	payload, err := json.Marshal(SignedOutcome{Outcome: outcome, Signer: signer.ID(), Signature: signer.Sign(body)})
+	if err != nil {
+		return block.VoteData{}, err
+	}
+	return block.VoteData{BallotID: ballotID, ChoiceID: outcome.Winner, Type: block.TxOutcome, Payload: string(payload)}, nil
+}
+
+// Outcome returns the outcome recorded for a ballot, or nil.
+func (s *State) Outcome(ballotID string) *SignedOutcome {
+	return s.lookup(ballotID).Outcome
+}
+
+// validateOutcome re-evaluates the ballot so that an outcome record can only
+// state what the ledger actually supports.
+func validateOutcome(s *State, data block.VoteData) error {
+	var so SignedOutcome
+	if err := json.Unmarshal([]byte(data.Payload), &so); err != nil {
+		return fmt.Errorf("invalid outcome: %v", err)
+	}
+	body, err := json.Marshal(so.Outcome)
+	if err != nil {
+		return err
+	}
+	if !cryptography.VerifySignature(so.Signer, body, so.Signature) {
+		return errors.New("outcome signature is invalid")
+	}
+
+	expected, err := s.Evaluate(data.BallotID)
+	if err != nil {
+		return err
+	}
+	expectedBody, err := json.Marshal(expected)
+	if err != nil {
+		return err
+	}
+	if string(expectedBody) != string(body) || data.ChoiceID != expected.Winner {
+		return errors.New("outcome does not match the ledger")
+	}
+	return nil
+}
+
+// validatePolicy ensures the policy is committed once, by an admin, before
+// voting starts.
+func validatePolicy(s *State, data block.VoteData) error {
+	if err := s.checkAdminSignature(data); err != nil {
+		return err
+	}
+	var p Policy
+	if err := json.Unmarshal([]byte(data.Payload), &p); err != nil {
+		return fmt.Errorf("invalid policy: %v", err)
+	}
+	if err := p.Validate(); err != nil {
+		return err
+	}
+	bs := s.lookup(data.BallotID)
+	if bs.Policy != nil {
+		return errors.New("policy already committed for this ballot")
+	}
+	if bs.Voted {
+		return errors.New("ballot already has votes; the policy can no longer be set")
+	}
+	return nil
+}
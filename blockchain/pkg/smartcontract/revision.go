@@ -0,0 +1,77 @@
+package smartcontract
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"voting-blockchain/pkg/block"
+)
+
+// Revision is the payload of a revote record. Supersedes is the hash of the
+// block holding the voter's latest vote, so each revision names exactly the
+// vote it replaces.
+type Revision struct {
+	Supersedes string `json:"supersedes"`
+}
+
+// VoteRecord builds the record for a voter's vote: a plain vote the first
+// time, and a revote superseding their latest vote afterwards.
+func VoteRecord(chain block.Blockchain, ballotID, voterID, choiceID string) (block.VoteData, error) {
+	s, err := Replay(chain)
+	if err != nil {
+		return block.VoteData{}, err
+	}
+	return s.VoteRecord(ballotID, voterID, choiceID)
+}
+
+// VoteRecord builds the record for a voter's vote against the state.
+func (s *State) VoteRecord(ballotID, voterID, choiceID string) (block.VoteData, error) {
+	vote := block.VoteData{BallotID: ballotID, ChoiceID: choiceID, VoterID: voterID}
+	if voterID == "" {
+		return vote, nil
+	}
+	votes, ok := s.lookup(ballotID).Voters[voterID]
+	if !ok {
+		return vote, nil
+	}
+
+	payload, err := json.Marshal(Revision{Supersedes: votes.Latest.Hash})
+	if err != nil {
+		return block.VoteData{}, err
+	}
+	vote.Type = block.TxRevote
+	vote.Payload = string(payload)
+	return vote, nil
+}
+
+func supersedes(data block.VoteData) string {
+	var rev Revision
+	if err := json.Unmarshal([]byte(data.Payload), &rev); err != nil {
+		return ""
+	}
+	return rev.Supersedes
+}
+
+func validateRevision(s *State, data block.VoteData) error {
+	if data.VoterID == "" {
+		return errors.New("voter id is required")
+	}
+	// Revisions replace a counted vote, so unlike votes in open rooms they
+	// are always signed
+	if data.Signature == "" {
+		return errors.New("revisions must be signed by the voter")
+	}
+	bs := s.lookup(data.BallotID)
+	if !bs.policy().AllowRevision {
+		return fmt.Errorf("voter %q has already voted and this ballot does not allow revisions", data.VoterID)
+	}
+
+	votes, ok := bs.Voters[data.VoterID]
+	if !ok {
+		return fmt.Errorf("voter %q has no vote to revise", data.VoterID)
+	}
+	if supersedes(data) != votes.Latest.Hash {
+		return errors.New("revision does not supersede the voter's latest vote")
+	}
+	return nil
+}
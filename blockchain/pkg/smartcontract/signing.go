@@ -0,0 +1,61 @@
+package smartcontract
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"voting-blockchain/pkg/block"
+	"voting-blockchain/pkg/cryptography"
+)
+
+// RecordSigningBody returns the bytes the signer of a record signs: the
+// record without its signature, bound to the room it is added to. A revote
+// is signed as the plain vote it is built from, since whether a vote
+// revises an earlier one is up to the ledger; the nonce keeps the signature
+// from being used twice.
+func RecordSigningBody(roomID string, data block.VoteData) []byte {
+	data.Signature = ""
+	if data.Type == block.TxRevote {
+		data.Type, data.Payload = block.TxVote, ""
+	}
+	body, _ := json.Marshal(struct {
+		Room   string         `json:"room"`
+		Record block.VoteData `json:"record"`
+	}{roomID, data})
+	return body
+}
+
+// checkRecordSignature checks that a record is signed by signer, with the
+// key they registered in the room and the next nonce of that key, and
+// returns the key.
+func (s *State) checkRecordSignature(data block.VoteData, signer string) (string, error) {
+	if data.Signature == "" {
+		return "", fmt.Errorf("record must be signed by %q", signer)
+	}
+	if data.Signer != signer {
+		return "", fmt.Errorf("record is signed by %q, not %q", data.Signer, signer)
+	}
+	key := s.Members[signer].Key
+	if !s.Members.IsMember(signer) || key == "" {
+		return "", fmt.Errorf("%q has no key to sign the record with", signer)
+	}
+	if data.Nonce != s.Nonces[key] {
+		return "", fmt.Errorf("record has nonce %d, expected %d", data.Nonce, s.Nonces[key])
+	}
+	if !cryptography.VerifySignature(key, RecordSigningBody(s.Room, data), data.Signature) {
+		return "", fmt.Errorf("record is not signed by %q", signer)
+	}
+	return key, nil
+}
+
+// checkAdminSignature checks that a record is signed by an admin of the room.
+func (s *State) checkAdminSignature(data block.VoteData) error {
+	if data.Signature == "" {
+		return errors.New("record must be signed by an admin of the room")
+	}
+	if !s.Members.IsMember(data.Signer) || s.Members[data.Signer].Role != RoleAdmin {
+		return fmt.Errorf("%q is not an admin of this room", data.Signer)
+	}
+	_, err := s.checkRecordSignature(data, data.Signer)
+	return err
+}
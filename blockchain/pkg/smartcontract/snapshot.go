@@ -0,0 +1,197 @@
+package smartcontract
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"voting-blockchain/pkg/block"
+)
+
+// Checkpoint is the payload of a checkpoint record. It commits to the root
+// of the room state after every block before it, so a node holding a
+// snapshot of that state can start the room's chain at the checkpoint
+// instead of at genesis.
+type Checkpoint struct {
+	Height    int    `json:"height"`    // Index of the checkpoint block
+	StateRoot string `json:"stateRoot"` // Root of the state before it
+}
+
+// snapshots holds the encoded states that chains starting after genesis are
+// replayed from, keyed by the hash of the last block each state covers.
+var (
+	snapshotsMu sync.RWMutex
+	snapshots   = make(map[string][]byte)
+)
+
+// Root returns the state root: the SHA-256 of the state's JSON encoding,
+// which is canonical because maps are encoded with sorted keys.
+func (s *State) Root() (string, error) {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// CheckpointRecord builds the checkpoint record committing to the state of
+// a chain.
+func CheckpointRecord(chain block.Blockchain) (block.VoteData, error) {
+	s, err := Replay(chain)
+	if err != nil {
+		return block.VoteData{}, err
+	}
+	return s.CheckpointRecord()
+}
+
+// CheckpointRecord builds the checkpoint record committing to the state.
+func (s *State) CheckpointRecord() (block.VoteData, error) {
+	root, err := s.Root()
+	if err != nil {
+		return block.VoteData{}, err
+	}
+	payload, err := json.Marshal(Checkpoint{Height: s.Height, StateRoot: root})
+	if err != nil {
+		return block.VoteData{}, err
+	}
+	return block.VoteData{Type: block.TxCheckpoint, Payload: string(payload)}, nil
+}
+
+// CheckpointDue reports whether interval blocks have been added since the
+// last checkpoint, or since genesis if there is none.
+func (s *State) CheckpointDue(interval int) bool {
+	return interval > 0 && s.Height-s.Checkpoint >= interval
+}
+
+// LatestCheckpoint returns the position in chain of the last checkpoint
+// block, or -1 if the chain has none.
+func LatestCheckpoint(chain block.Blockchain) int {
+	for i := len(chain) - 1; i >= 0; i-- {
+		if chain[i].Data.Type == block.TxCheckpoint {
+			return i
+		}
+	}
+	return -1
+}
+
+// VerifySnapshot checks that a snapshot is the state committed to by a
+// checkpoint block, and so the state a chain starting at that block is
+// replayed from. The block itself must come from a trusted source, such as
+// a chain whose work the caller has checked.
+func VerifySnapshot(s *State, checkpoint block.Block) error {
+	if !block.ValidateBlock(&checkpoint) {
+		return errors.New("checkpoint block has been tampered with")
+	}
+	if checkpoint.Data.Type != block.TxCheckpoint {
+		return fmt.Errorf("block %d is not a checkpoint", checkpoint.Index)
+	}
+	var c Checkpoint
+	if err := json.Unmarshal([]byte(checkpoint.Data.Payload), &c); err != nil {
+		return fmt.Errorf("invalid checkpoint: %v", err)
+	}
+	if c.Height != checkpoint.Index || s.Height != checkpoint.Index {
+		return fmt.Errorf("snapshot of height %d does not match checkpoint %d", s.Height, checkpoint.Index)
+	}
+	if s.Tip != checkpoint.PrevHash {
+		return errors.New("snapshot does not end at the block before the checkpoint")
+	}
+	root, err := s.Root()
+	if err != nil {
+		return err
+	}
+	if root != c.StateRoot {
+		return errors.New("snapshot does not match the checkpoint's state root")
+	}
+	return nil
+}
+
+// AddSnapshot registers a state that chains holding its tip, or starting
+// right after it, are replayed from instead of from the blocks it covers.
+func AddSnapshot(s *State) error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	snapshotsMu.Lock()
+	defer snapshotsMu.Unlock()
+	snapshots[s.Tip] = data
+	return nil
+}
+
+// DecodeState decodes a state encoded as JSON.
+func DecodeState(data []byte) (*State, error) {
+	s := NewState()
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, err
+	}
+	if s.Members == nil {
+		s.Members = make(Membership)
+	}
+	if s.Nonces == nil {
+		s.Nonces = make(map[string]int64)
+	}
+	if s.Delegations == nil {
+		s.Delegations = make(map[string]string)
+	}
+	if s.Ballots == nil {
+		s.Ballots = make(map[string]*BallotState)
+	}
+	return s, nil
+}
+
+// baseState returns the state the first n blocks of a chain are replayed
+// from and the position to replay from: the latest snapshot registered for
+// one of those blocks, or the empty state for chains starting at genesis.
+func baseState(chain block.Blockchain, n int) (*State, int, error) {
+	if len(chain) == 0 {
+		return NewState(), 0, nil
+	}
+	snapshotsMu.RLock()
+	defer snapshotsMu.RUnlock()
+	for start := n; start >= 0; start-- {
+		tip, height := chain[0].PrevHash, chain[0].Index
+		if start > 0 {
+			tip, height = chain[start-1].Hash, chain[start-1].Index+1
+		}
+		data, ok := snapshots[tip]
+		if !ok {
+			continue
+		}
+		s, err := DecodeState(data)
+		if err != nil {
+			return nil, 0, err
+		}
+		if s.Height != height {
+			return nil, 0, fmt.Errorf("snapshot of height %d does not precede block %d", s.Height, height)
+		}
+		return s, start, nil
+	}
+	if chain[0].Index != 0 {
+		return nil, 0, fmt.Errorf("no snapshot to replay the chain from block %d", chain[0].Index)
+	}
+	return NewState(), 0, nil
+}
+
+func validateCheckpoint(s *State, data block.VoteData) error {
+	if data.BallotID != "" {
+		return errors.New("checkpoint records belong to the room, not a ballot")
+	}
+	var c Checkpoint
+	if err := json.Unmarshal([]byte(data.Payload), &c); err != nil {
+		return fmt.Errorf("invalid checkpoint: %v", err)
+	}
+	if c.Height != s.Height {
+		return fmt.Errorf("checkpoint is for height %d, not %d", c.Height, s.Height)
+	}
+	root, err := s.Root()
+	if err != nil {
+		return err
+	}
+	if c.StateRoot != root {
+		return errors.New("checkpoint does not match the room state")
+	}
+	return nil
+}
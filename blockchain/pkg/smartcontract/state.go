@@ -0,0 +1,245 @@
+package smartcontract
+
+import (
+	"encoding/json"
+	"fmt"
+	"voting-blockchain/pkg/block"
+)
+
+// State is the state of a room after a prefix of its chain: its members,
+// room-wide delegations and ballots. The rules and tallies of this package
+// are evaluated against the State built by applying a chain's blocks in
+// order, so a node holding a verified snapshot of the State can carry on
+// from it without the blocks it summarizes.
+type State struct {
+	Height      int                     `json:"height"`     // Index of the next block
+	Tip         string                  `json:"tip"`        // Hash of the last block applied
+	Room        string                  `json:"room"`       // Room ID recorded in the genesis block
+	Checkpoint  int                     `json:"checkpoint"` // Index of the last checkpoint block
+	Members     Membership              `json:"members"`
+	Nonces      map[string]int64        `json:"nonces"`      // Membership changes and records signed by each member key
+	Delegations map[string]string       `json:"delegations"` // Room-wide delegations
+	Ballots     map[string]*BallotState `json:"ballots"`
+}
+
+// BallotState is the state of one ballot. Voters holds the votes of every
+// named voter, so it doubles as the ballot's nullifier set.
+type BallotState struct {
+	Lifecycle   Lifecycle             `json:"lifecycle"`
+	Managed     bool                  `json:"managed,omitempty"` // Whether the ballot has a state record
+	Weights     WeightTable           `json:"weights"`
+	Policy      *Policy               `json:"policy,omitempty"`
+	Voted       bool                  `json:"voted,omitempty"`     // Whether the ballot has a plain vote
+	Anonymous   map[string]int64      `json:"anonymous,omitempty"` // Votes without a voter id, by choice
+	Voters      map[string]VoterVotes `json:"voters,omitempty"`
+	Delegations map[string]string     `json:"delegations,omitempty"` // Ballot-scoped delegations
+	Closed      bool                  `json:"closed,omitempty"`
+	Results     map[string]int64      `json:"results,omitempty"` // Tally as of the record closing the ballot
+	Outcome     *SignedOutcome        `json:"outcome,omitempty"`
+}
+
+// VoterVotes holds a voter's first vote and the latest one reached by
+// following the revisions superseding it.
+type VoterVotes struct {
+	First  CastVote `json:"first"`
+	Latest CastVote `json:"latest"`
+}
+
+// CastVote is a choice and the hash of the block recording it.
+type CastVote struct {
+	Choice string `json:"choice"`
+	Hash   string `json:"hash"`
+}
+
+// NewState returns the state of a room before its genesis block.
+func NewState() *State {
+	return &State{
+		Members:     make(Membership),
+		Nonces:      make(map[string]int64),
+		Delegations: make(map[string]string),
+		Ballots:     make(map[string]*BallotState),
+	}
+}
+
+// Replay builds the state of a room from its chain. The chain is replayed
+// from the latest snapshot registered for one of its blocks (see
+// AddSnapshot), or from genesis if it has none, so chains that start after
+// genesis or hold archived blocks need a snapshot past those blocks.
+func Replay(chain block.Blockchain) (*State, error) {
+	return StateAt(chain, len(chain))
+}
+
+// StateAt builds the state after the first n blocks of chain.
+func StateAt(chain block.Blockchain, n int) (*State, error) {
+	s, start, err := baseState(chain, n)
+	if err != nil {
+		return nil, err
+	}
+	for _, b := range chain[start:n] {
+		if b.Archived {
+			return nil, fmt.Errorf("block %d is archived and no snapshot covers it", b.Index)
+		}
+		s.Apply(b)
+	}
+	return s, nil
+}
+
+// Apply adds the next block to the state. Blocks received from peers are
+// not checked against the record rules, so records that are malformed or do
+// not apply are skipped rather than failing the replay. Ballots whose start
+// or end time has passed by the block's timestamp open or close first.
+func (s *State) Apply(b block.Block) {
+	s.Height, s.Tip = b.Index+1, b.Hash
+	if b.Index == 0 {
+		s.Room = b.Data.Payload
+	}
+	s.advance(b.Timestamp)
+	data := b.Data
+	if data.Signature != "" && data.Type != block.TxMember {
+		if key, err := s.checkRecordSignature(data, data.Signer); err == nil {
+			s.Nonces[key]++
+		}
+	}
+
+	switch data.Type {
+	case block.TxMember:
+		var c MembershipChange
+		if json.Unmarshal([]byte(data.Payload), &c) != nil {
+			return
+		}
+		key, err := s.checkSignature(data.VoterID, c)
+		if err == nil && s.Members.apply(data.VoterID, c) == nil {
+			s.Nonces[key]++
+		}
+		return
+	case block.TxCheckpoint:
+		s.Checkpoint = b.Index
+		return
+	case block.TxDelegate, block.TxRevoke:
+		if data.BallotID == "" {
+			applyDelegation(s.Delegations, data)
+		} else {
+			applyDelegation(s.ballot(data.BallotID).Delegations, data)
+		}
+		return
+	}
+
+	bs := s.ballot(data.BallotID)
+	switch data.Type {
+	case block.TxVote:
+		bs.Voted = true
+		if data.VoterID == "" {
+			bs.Anonymous[data.ChoiceID]++
+		} else if _, ok := bs.Voters[data.VoterID]; !ok {
+			vote := CastVote{Choice: data.ChoiceID, Hash: b.Hash}
+			bs.Voters[data.VoterID] = VoterVotes{First: vote, Latest: vote}
+		}
+	case block.TxRevote:
+		if votes, ok := bs.Voters[data.VoterID]; ok && supersedes(data) == votes.Latest.Hash {
+			votes.Latest = CastVote{Choice: data.ChoiceID, Hash: b.Hash}
+			bs.Voters[data.VoterID] = votes
+		}
+	case block.TxWeights:
+		var wt WeightTable
+		if bs.Weights == nil && json.Unmarshal([]byte(data.Payload), &wt) == nil {
+			bs.Weights = wt
+		}
+	case block.TxPolicy:
+		var p Policy
+		if bs.Policy == nil && json.Unmarshal([]byte(data.Payload), &p) == nil {
+			bs.Policy = &p
+		}
+	case block.TxState:
+		var t Transition
+		if json.Unmarshal([]byte(data.Payload), &t) != nil {
+			return
+		}
+		if t.State == StateClosed {
+			s.close(bs)
+		}
+		bs.Managed = true
+		bs.Lifecycle.State = t.State
+		if t.StartTime != 0 {
+			bs.Lifecycle.StartTime = t.StartTime
+		}
+		if t.EndTime != 0 {
+			bs.Lifecycle.EndTime = t.EndTime
+		}
+	case block.TxOutcome:
+		s.close(bs)
+		bs.Lifecycle.State = StateTallied
+		var so SignedOutcome
+		if bs.Outcome == nil && json.Unmarshal([]byte(data.Payload), &so) == nil {
+			bs.Outcome = &so
+		}
+	}
+}
+
+// Clone returns a copy of the state that can be advanced without changing
+// the original.
+func (s *State) Clone() *State {
+	c := *s
+	c.Members = s.Members.clone()
+	c.Nonces = copyMap(s.Nonces)
+	c.Delegations = copyMap(s.Delegations)
+	c.Ballots = make(map[string]*BallotState, len(s.Ballots))
+	for ballotID, bs := range s.Ballots {
+		b := *bs
+		b.Weights = copyMap(bs.Weights)
+		b.Anonymous = copyMap(bs.Anonymous)
+		b.Voters = copyMap(bs.Voters)
+		b.Delegations = copyMap(bs.Delegations)
+		b.Results = copyMap(bs.Results)
+		c.Ballots[ballotID] = &b
+	}
+	return &c
+}
+
+// copyMap returns a copy of m, nil if m is nil.
+func copyMap[K comparable, V any](m map[K]V) map[K]V {
+	if m == nil {
+		return nil
+	}
+	c := make(map[K]V, len(m))
+	for k, v := range m {
+		c[k] = v
+	}
+	return c
+}
+
+// close freezes the tally of a ballot at the first record closing it.
+func (s *State) close(bs *BallotState) {
+	if !bs.Closed {
+		bs.Results = s.count(bs)
+		bs.Closed = true
+	}
+}
+
+// ballot returns the state of a ballot, adding it if it is new.
+func (s *State) ballot(ballotID string) *BallotState {
+	bs, ok := s.Ballots[ballotID]
+	if !ok {
+		bs = &BallotState{}
+		s.Ballots[ballotID] = bs
+	}
+	// Empty maps are left out of snapshots
+	if bs.Anonymous == nil {
+		bs.Anonymous = make(map[string]int64)
+	}
+	if bs.Voters == nil {
+		bs.Voters = make(map[string]VoterVotes)
+	}
+	if bs.Delegations == nil {
+		bs.Delegations = make(map[string]string)
+	}
+	return bs
+}
+
+// lookup returns the state of a ballot, or an empty state if the ballot has
+// no records.
+func (s *State) lookup(ballotID string) *BallotState {
+	if bs, ok := s.Ballots[ballotID]; ok {
+		return bs
+	}
+	return &BallotState{}
+}
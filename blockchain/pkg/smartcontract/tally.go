@@ -0,0 +1,214 @@
+package smartcontract
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"voting-blockchain/pkg/block"
+)
+
+// Tally computes the results of a ballot from the ledger. Unweighted ballots
+// count every vote once; weighted ballots count each registered voter with
+// the weight fixed in the ballot's weight table. A named voter's latest valid
+// vote counts on ballots allowing revisions, their first vote otherwise.
+// Voters who did not vote directly are counted through their delegation
+// chain, so direct votes always override delegations.
+func Tally(chain block.Blockchain, ballotID string) (map[string]int64, error) {
+	s, err := Replay(chain)
+	if err != nil {
+		return nil, err
+	}
+	return s.Tally(ballotID), nil
+}
+
+// TallyRecords computes the results of a ballot from a chain's records that
+// its tally depends on: its own records and the room-wide delegations, in
+// chain order from genesis. Other records may be included and are ignored,
+// so a ballot can be tallied from a ledger's ballot index instead of the
+// whole chain.
+func TallyRecords(records block.Blockchain, ballotID string) map[string]int64 {
+	s := NewState()
+	for _, b := range records {
+		s.Apply(b)
+	}
+	return s.Tally(ballotID)
+}
+
+// Tally computes the results of a ballot. Closed ballots are tallied as of
+// the record that closed them.
+func (s *State) Tally(ballotID string) map[string]int64 {
+	bs := s.lookup(ballotID)
+	if !bs.Closed {
+		return s.count(bs)
+	}
+	results := make(map[string]int64, len(bs.Results))
+	for choice, count := range bs.Results {
+		results[choice] = count
+	}
+	return results
+}
+
+// count tallies a ballot as of the current state.
+func (s *State) count(bs *BallotState) map[string]int64 {
+	weightOf := func(voter string) (int64, bool) {
+		if bs.Weights == nil {
+			return 1, true
+		}
+		weight, ok := bs.Weights[voter]
+		return weight, ok
+	}
+
+	results := make(map[string]int64)
+	// Anonymous votes predate voter ids and only count on unweighted ballots
+	if bs.Weights == nil {
+		for choice, count := range bs.Anonymous {
+			results[choice] += count
+		}
+	}
+
+	allowRevision := bs.policy().AllowRevision
+	direct := make(map[string]string)
+	for voter, votes := range bs.Voters {
+		if _, ok := weightOf(voter); !ok {
+			continue
+		}
+		if allowRevision {
+			direct[voter] = votes.Latest.Choice
+		} else {
+			direct[voter] = votes.First.Choice
+		}
+	}
+
+	for voter, choice := range direct {
+		weight, _ := weightOf(voter)
+		results[choice] += weight
+	}
+	delegates := s.activeDelegations(bs)
+	for voter := range delegates {
+		if _, ok := direct[voter]; ok {
+			continue
+		}
+		weight, ok := weightOf(voter)
+		if !ok {
+			continue
+		}
+		if choice, ok := resolveDelegation(voter, delegates, direct); ok {
+			results[choice] += weight
+		}
+	}
+	return results
+}
+
+// ValidateRecord checks whether a new record, in a block timestamped at, may
+// be appended to the ledger.
+func ValidateRecord(chain block.Blockchain, data block.VoteData, at int64) error {
+	s, err := Replay(chain)
+	if err != nil {
+		return err
+	}
+	return s.Validate(data, at)
+}
+
+// Validate checks whether a record may be added to the state in a block
+// timestamped at, in Unix seconds. Ballot deadlines are checked against the
+// block's timestamp, so every node replaying a chain reaches the same result.
+func (s *State) Validate(data block.VoteData, at int64) error {
+	if data.BallotID != "" {
+		if err := s.LifecycleAt(data.BallotID, at).admits(data, at); err != nil {
+			return err
+		}
+	}
+
+	switch data.Type {
+	case block.TxMember:
+		return validateMembership(s, data)
+	case block.TxCheckpoint:
+		return validateCheckpoint(s, data)
+	case block.TxDelegate:
+		if err := checkMember(s, data.VoterID); err != nil {
+			return err
+		}
+		return validateDelegation(s, data)
+	case block.TxRevoke:
+		return validateRevocation(s, data)
+	}
+
+	// Every other record belongs to a ballot
+	if data.BallotID == "" {
+		return errors.New("ballot id is required")
+	}
+	switch data.Type {
+	case block.TxVote:
+		return validateVote(s, data)
+	case block.TxRevote:
+		if err := validateChoice(s, data); err != nil {
+			return err
+		}
+		return validateRevision(s, data)
+	case block.TxWeights:
+		return validateWeights(s, data)
+	case block.TxPolicy:
+		return validatePolicy(s, data)
+	case block.TxOutcome:
+		return validateOutcome(s, data)
+	case block.TxState:
+		return validateTransition(s, data, at)
+	default:
+		return fmt.Errorf("unknown record type %q", data.Type)
+	}
+}
+
+func validateVote(s *State, data block.VoteData) error {
+	if err := validateChoice(s, data); err != nil {
+		return err
+	}
+	if _, ok := s.lookup(data.BallotID).Voters[data.VoterID]; data.VoterID != "" && ok {
+		return fmt.Errorf("voter %q has already voted; revisions must supersede the earlier vote", data.VoterID)
+	}
+	return nil
+}
+
+// validateChoice checks the parts shared by votes and revotes.
+func validateChoice(s *State, data block.VoteData) error {
+	if data.ChoiceID == "" {
+		return errors.New("choice id is required")
+	}
+	if err := checkMember(s, data.VoterID); err != nil {
+		return err
+	}
+	// Members sign their votes; voters in open rooms have no key to sign with
+	if !s.Members.Open() || data.Signature != "" {
+		if _, err := s.checkRecordSignature(data, data.VoterID); err != nil {
+			return err
+		}
+	}
+	if weights := s.lookup(data.BallotID).Weights; weights != nil {
+		if _, ok := weights[data.VoterID]; !ok {
+			return fmt.Errorf("voter %q is not registered for this ballot", data.VoterID)
+		}
+	}
+	return nil
+}
+
+// validateWeights ensures the weight table is committed once, by an admin,
+// before voting starts, so the snapshot cannot change under an open ballot.
+func validateWeights(s *State, data block.VoteData) error {
+	if err := s.checkAdminSignature(data); err != nil {
+		return err
+	}
+	var wt WeightTable
+	if err := json.Unmarshal([]byte(data.Payload), &wt); err != nil {
+		return fmt.Errorf("invalid weight table: %v", err)
+	}
+	if err := wt.Validate(); err != nil {
+		return err
+	}
+	bs := s.lookup(data.BallotID)
+	if bs.Weights != nil {
+		return errors.New("weight table already committed for this ballot")
+	}
+	if bs.Voted {
+		return errors.New("ballot already has votes; weights can no longer be set")
+	}
+	return nil
+}
@@ -0,0 +1,52 @@
+package smartcontract
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"voting-blockchain/pkg/block"
+)
+
+// WeightTable maps each registered voter of a ballot to the weight (shares
+// or stake) their vote carries. It is committed on-chain before the first
+// vote so that weighted results can be audited from the ledger alone.
+type WeightTable map[string]int64
+
+// Validate checks that the table is usable for tallying.
+func (wt WeightTable) Validate() error {
+	if len(wt) == 0 {
+		return errors.New("weight table is empty")
+	}
+	for voter, weight := range wt {
+		if voter == "" {
+			return errors.New("weight table contains an empty voter id")
+		}
+		if weight <= 0 {
+			return fmt.Errorf("voter %s has non-positive weight %d", voter, weight)
+		}
+	}
+	return nil
+}
+
+// Record builds the ledger record committing the table for a ballot.
+func (wt WeightTable) Record(ballotID string) (block.VoteData, error) {
+	if err := wt.Validate(); err != nil {
+		return block.VoteData{}, err
+	}
+	// encoding/json sorts map keys, so the payload is deterministic
+	payload, err := json.Marshal(wt)
+	if err != nil {
+		return block.VoteData{}, err
+	}
+	return block.VoteData{BallotID: ballotID, Type: block.TxWeights, Payload: string(payload)}, nil
+}
+
+// FindWeights returns the weight table committed for a ballot, or nil if the
+// ballot is unweighted.
+func FindWeights(chain block.Blockchain, ballotID string) (WeightTable, error) {
+	s, err := Replay(chain)
+	if err != nil {
+		return nil, err
+	}
+	return s.lookup(ballotID).Weights, nil
+}
@@ -0,0 +1,193 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"voting-blockchain/pkg/fsutil"
+)
+
+// FileRoomStore is a RoomStore kept in a JSON file. Every change rewrites the
+// file atomically before it is reported as done; a change that cannot be
+// written is undone.
+type FileRoomStore struct {
+	mu   sync.Mutex // Serializes changes so the file always holds the latest
+	path string
+	mem  *MemoryRoomStore
+}
+
+// FileBallotStore is a BallotStore kept in a JSON file, written the same way
+// as FileRoomStore.
+type FileBallotStore struct {
+	mu   sync.Mutex
+	path string
+	mem  *MemoryBallotStore
+}
+
+// OpenFileRoomStore loads the rooms saved at path. A missing file is an
+// empty store.
+func OpenFileRoomStore(path string) (*FileRoomStore, error) {
+	var rooms []*Room
+	if err := readJSON(path, &rooms); err != nil {
+		return nil, err
+	}
+	s := &FileRoomStore{path: path, mem: NewMemoryRoomStore()}
+	for _, room := range rooms {
+		s.mem.put(room)
+	}
+	return s, nil
+}
+
+// OpenFileBallotStore loads the ballots saved at path. A missing file is an
+// empty store.
+func OpenFileBallotStore(path string) (*FileBallotStore, error) {
+	var ballots []*Ballot
+	if err := readJSON(path, &ballots); err != nil {
+		return nil, err
+	}
+	s := &FileBallotStore{path: path, mem: NewMemoryBallotStore()}
+	for _, ballot := range ballots {
+		s.mem.put(ballot)
+	}
+	return s, nil
+}
+
+func (s *FileRoomStore) CreateRoom(id, name, description, roomType string) (*Room, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	room, err := s.mem.CreateRoom(id, name, description, roomType)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.save(); err != nil {
+		s.mem.DeleteRoom(room.ID)
+		return nil, err
+	}
+	return room, nil
+}
+
+func (s *FileRoomStore) GetRoom(id string) (*Room, error) {
+	return s.mem.GetRoom(id)
+}
+
+func (s *FileRoomStore) ListRooms() ([]*Room, error) {
+	return s.mem.ListRooms()
+}
+
+func (s *FileRoomStore) UpdateRoom(room *Room) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	old, err := s.mem.GetRoom(room.ID)
+	if err != nil {
+		return err
+	}
+	s.mem.put(room)
+	if err := s.save(); err != nil {
+		s.mem.put(old)
+		return err
+	}
+	return nil
+}
+
+func (s *FileRoomStore) DeleteRoom(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	old, err := s.mem.GetRoom(id)
+	if err != nil {
+		return err
+	}
+	s.mem.DeleteRoom(id)
+	if err := s.save(); err != nil {
+		s.mem.put(old)
+		return err
+	}
+	return nil
+}
+
+func (s *FileRoomStore) save() error {
+	rooms, _ := s.mem.ListRooms()
+	return writeJSON(s.path, rooms)
+}
+
+func (s *FileBallotStore) CreateBallot(id, roomID, title, description string, options []string) (*Ballot, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ballot, err := s.mem.CreateBallot(id, roomID, title, description, options)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.save(); err != nil {
+		s.mem.DeleteBallot(ballot.RoomID, ballot.ID)
+		return nil, err
+	}
+	return ballot, nil
+}
+
+func (s *FileBallotStore) GetBallot(roomID, id string) (*Ballot, error) {
+	return s.mem.GetBallot(roomID, id)
+}
+
+func (s *FileBallotStore) ListBallots(roomID string) ([]*Ballot, error) {
+	return s.mem.ListBallots(roomID)
+}
+
+func (s *FileBallotStore) UpdateBallot(ballot *Ballot) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	old, err := s.mem.GetBallot(ballot.RoomID, ballot.ID)
+	if err != nil {
+		return err
+	}
+	s.mem.put(ballot)
+	if err := s.save(); err != nil {
+		s.mem.put(old)
+		return err
+	}
+	return nil
+}
+
+func (s *FileBallotStore) DeleteBallot(roomID, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	old, err := s.mem.GetBallot(roomID, id)
+	if err != nil {
+		return err
+	}
+	s.mem.DeleteBallot(roomID, id)
+	if err := s.save(); err != nil {
+		s.mem.put(old)
+		return err
+	}
+	return nil
+}
+
+func (s *FileBallotStore) save() error {
+	ballots, _ := s.mem.ListBallots("")
+	return writeJSON(s.path, ballots)
+}
+
+func readJSON(path string, v interface{}) error {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// writeJSON replaces the file at path with v. The data is synced to disk
+// before the rename so a crash leaves either the old or the new file.
+func writeJSON(path string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return fsutil.WriteFileAtomic(path, data)
+}
@@ -0,0 +1,197 @@
+package storage
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+// MemoryRoomStore is a RoomStore that keeps rooms in memory only.
+type MemoryRoomStore struct {
+	mu    sync.RWMutex
+	rooms map[string]*Room
+}
+
+// MemoryBallotStore is a BallotStore that keeps ballots in memory only.
+type MemoryBallotStore struct {
+	mu      sync.RWMutex
+	ballots map[ballotKey]*Ballot
+}
+
+type ballotKey struct {
+	roomID, id string
+}
+
+func NewMemoryRoomStore() *MemoryRoomStore {
+	return &MemoryRoomStore{
+		rooms: make(map[string]*Room),
+	}
+}
+
+func NewMemoryBallotStore() *MemoryBallotStore {
+	return &MemoryBallotStore{
+		ballots: make(map[ballotKey]*Ballot),
+	}
+}
+
+// Create a new room, generating an ID if none is given
+func (s *MemoryRoomStore) CreateRoom(id, name, description, roomType string) (*Room, error) {
+	if id == "" {
+		id = uuid.New().String()
+	}
+	room := &Room{
+		ID:              id,
+		Name:            name,
+		Description:     description,
+		Type:            roomType,
+		Participants:    []string{},
+		PendingRequests: []string{},
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.rooms[id]; ok {
+		return nil, fmt.Errorf("room %s %w", id, ErrExists)
+	}
+	s.rooms[id] = room
+	return room.clone(), nil
+}
+
+// Get a room by ID
+func (s *MemoryRoomStore) GetRoom(id string) (*Room, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	room, ok := s.rooms[id]
+	if !ok {
+		return nil, fmt.Errorf("room %s %w", id, ErrNotFound)
+	}
+	return room.clone(), nil
+}
+
+// List every room ordered by ID
+func (s *MemoryRoomStore) ListRooms() ([]*Room, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	rooms := make([]*Room, 0, len(s.rooms))
+	for _, room := range s.rooms {
+		rooms = append(rooms, room.clone())
+	}
+	sort.Slice(rooms, func(i, j int) bool { return rooms[i].ID < rooms[j].ID })
+	return rooms, nil
+}
+
+// Replace an existing room
+func (s *MemoryRoomStore) UpdateRoom(room *Room) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.rooms[room.ID]; !ok {
+		return fmt.Errorf("room %s %w", room.ID, ErrNotFound)
+	}
+	s.rooms[room.ID] = room.clone()
+	return nil
+}
+
+// Delete a room
+func (s *MemoryRoomStore) DeleteRoom(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.rooms[id]; !ok {
+		return fmt.Errorf("room %s %w", id, ErrNotFound)
+	}
+	delete(s.rooms, id)
+	return nil
+}
+
+// put stores a room as is, used to load and roll back file stores
+func (s *MemoryRoomStore) put(room *Room) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rooms[room.ID] = room.clone()
+}
+
+// Create a new ballot, generating an ID if none is given
+func (s *MemoryBallotStore) CreateBallot(id, roomID, title, description string, options []string) (*Ballot, error) {
+	if id == "" {
+		id = uuid.New().String()
+	}
+	ballot := &Ballot{
+		ID:          id,
+		RoomID:      roomID,
+		Title:       title,
+		Description: description,
+		Options:     append([]string{}, options...),
+		Voters:      []string{},
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := ballotKey{roomID, id}
+	if _, ok := s.ballots[key]; ok {
+		return nil, fmt.Errorf("ballot %s in room %s %w", id, roomID, ErrExists)
+	}
+	s.ballots[key] = ballot
+	return ballot.clone(), nil
+}
+
+// Get a ballot of a room by ID
+func (s *MemoryBallotStore) GetBallot(roomID, id string) (*Ballot, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	ballot, ok := s.ballots[ballotKey{roomID, id}]
+	if !ok {
+		return nil, fmt.Errorf("ballot %s in room %s %w", id, roomID, ErrNotFound)
+	}
+	return ballot.clone(), nil
+}
+
+// List the ballots of a room, or of every room if roomID is empty
+func (s *MemoryBallotStore) ListBallots(roomID string) ([]*Ballot, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	ballots := []*Ballot{}
+	for key, ballot := range s.ballots {
+		if roomID == "" || key.roomID == roomID {
+			ballots = append(ballots, ballot.clone())
+		}
+	}
+	sort.Slice(ballots, func(i, j int) bool {
+		if ballots[i].RoomID != ballots[j].RoomID {
+			return ballots[i].RoomID < ballots[j].RoomID
+		}
+		return ballots[i].ID < ballots[j].ID
+	})
+	return ballots, nil
+}
+
+// Replace an existing ballot
+func (s *MemoryBallotStore) UpdateBallot(ballot *Ballot) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := ballotKey{ballot.RoomID, ballot.ID}
+	if _, ok := s.ballots[key]; !ok {
+		return fmt.Errorf("ballot %s in room %s %w", ballot.ID, ballot.RoomID, ErrNotFound)
+	}
+	s.ballots[key] = ballot.clone()
+	return nil
+}
+
+// Delete a ballot
+func (s *MemoryBallotStore) DeleteBallot(roomID, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := ballotKey{roomID, id}
+	if _, ok := s.ballots[key]; !ok {
+		return fmt.Errorf("ballot %s in room %s %w", id, roomID, ErrNotFound)
+	}
+	delete(s.ballots, key)
+	return nil
+}
+
+// put stores a ballot as is, used to load and roll back file stores
+func (s *MemoryBallotStore) put(ballot *Ballot) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ballots[ballotKey{ballot.RoomID, ballot.ID}] = ballot.clone()
+}
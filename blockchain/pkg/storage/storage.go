@@ -1,7 +1,14 @@
 package storage
 
 import (
-	"github.com/google/uuid"
+	"errors"
+)
+
+var (
+	// ErrNotFound is returned when a room or ballot does not exist.
+	ErrNotFound = errors.New("not found")
+	// ErrExists is returned when creating a room or ballot whose ID is taken.
+	ErrExists = errors.New("already exists")
 )
 
 // Room represents a voting room
@@ -24,50 +31,42 @@ type Ballot struct {
 	Voters      []string `json:"voters"`
 }
 
-type RoomStore struct {
-	rooms map[string]*Room
+// RoomStore keeps the metadata of rooms. Implementations are safe for
+// concurrent use and hand out copies, so callers may modify what they get
+// and save it back with UpdateRoom.
+type RoomStore interface {
+	// CreateRoom adds a room, generating an ID if none is given.
+	CreateRoom(id, name, description, roomType string) (*Room, error)
+	GetRoom(id string) (*Room, error)
+	// ListRooms returns every room ordered by ID.
+	ListRooms() ([]*Room, error)
+	UpdateRoom(room *Room) error
+	DeleteRoom(id string) error
 }
 
-type BallotStore struct {
-	ballots map[string]*Ballot
+// BallotStore keeps the metadata of ballots. Ballot IDs are unique within a
+// room. Implementations are safe for concurrent use and hand out copies.
+type BallotStore interface {
+	// CreateBallot adds a ballot, generating an ID if none is given.
+	CreateBallot(id, roomID, title, description string, options []string) (*Ballot, error)
+	GetBallot(roomID, id string) (*Ballot, error)
+	// ListBallots returns the ballots of a room, or of every room if roomID
+	// is empty, ordered by room and ID.
+	ListBallots(roomID string) ([]*Ballot, error)
+	UpdateBallot(ballot *Ballot) error
+	DeleteBallot(roomID, id string) error
 }
 
-func NewRoomStore() *RoomStore {
-	return &RoomStore{
-		rooms: make(map[string]*Room),
-	}
+func (r *Room) clone() *Room {
+	c := *r
+	c.Participants = append([]string{}, r.Participants...)
+	c.PendingRequests = append([]string{}, r.PendingRequests...)
+	return &c
 }
 
-func NewBallotStore() *BallotStore {
-	return &BallotStore{
-		ballots: make(map[string]*Ballot),
-	}
+func (b *Ballot) clone() *Ballot {
+	c := *b
+	c.Options = append([]string{}, b.Options...)
+	c.Voters = append([]string{}, b.Voters...)
+	return &c
 }
-
-// Create a new room
-func (s *RoomStore) CreateRoom(name, description, roomType string) (*Room, error) {
-	room := &Room{
-		ID:              uuid.New().String(),
-		Name:            name,
-		Description:     description,
-		Type:            roomType,
-		Participants:    []string{},
-		PendingRequests: []string{},
-	}
-	s.rooms[room.ID] = room
-	return room, nil
-}
-
-// Create a new ballot
-func (s *BallotStore) CreateBallot(roomID, title, description string, options []string) (*Ballot, error) {
-	ballot := &Ballot{
-		ID:          uuid.New().String(),
-		RoomID:      roomID,
-		Title:       title,
-		Description: description,
-		Options:     options,
-		Voters:      []string{},
-	}
-	s.ballots[ballot.ID] = ballot
-	return ballot, nil
-}
\ No newline at end of file